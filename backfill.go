@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"flag"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const BACKFILL_DATE_FORMAT = "2006-01-02"
+
+func parseBackfillDate(name string, value string) time.Time {
+	date, err := time.Parse(BACKFILL_DATE_FORMAT, value)
+	if err != nil {
+		log.WithFields(log.Fields{
+			name:    value,
+			"error": err,
+		}).Fatalf("Invalid %s date, expected format is YYYY-MM-DD", name)
+	}
+	return date
+}
+
+func backfill(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	since := flags.String("since", "", "First day (YYYY-MM-DD, UTC) to backfill metrics of, mandatory")
+	until := flags.String("until", time.Now().UTC().Format(BACKFILL_DATE_FORMAT), "Last day (YYYY-MM-DD, UTC) to backfill metrics of")
+	output := flags.String("output", "-", "File to write metrics in OpenMetrics format to, '-' for stdout")
+	flags.Parse(args)
+
+	if *since == "" {
+		log.Fatal("The since date to backfill metrics of is mandatory")
+	}
+	sinceDate := parseBackfillDate("since", *since)
+	untilDate := parseBackfillDate("until", *until)
+	if sinceDate.After(untilDate) {
+		log.Fatalf("The since date %s is later than the until date %s", *since, *until)
+	}
+
+	bitbucketRequestManager := initBitbucket(config)
+	options := metricsOptions(config)
+	metricsToBeCollected := metrics.NewMetricsWithOptions(options)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsToBeCollected.Collectors()...)
+	runner := newRunner(config, bitbucketRequestManager, metricsToBeCollected)
+
+	// Past days are rebuilt from the PRs & ref changes of a full collection
+	collectErr := runner.Collect()
+	history := metrics.NewHistory()
+	err := runner.Backfill(sinceDate, untilDate, options, history)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot backfill metrics")
+	}
+
+	if *output == "" || *output == "-" {
+		err = history.WriteOpenMetrics(os.Stdout)
+		if collectErr != nil || err != nil {
+			log.Error("Metrics backfill failed")
+			os.Exit(1)
+		}
+		return
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"output": *output,
+			"error":  err,
+		}).Fatal("Cannot create output file")
+	}
+	err = history.WriteOpenMetrics(file)
+	// Snapshots are only safe once the file is closed, so a failed close fails the backfill too
+	closeErr := file.Close()
+	if closeErr != nil {
+		log.WithFields(log.Fields{
+			"output": *output,
+			"error":  closeErr,
+		}).Error("Cannot close output file")
+	}
+	if collectErr != nil || err != nil || closeErr != nil {
+		log.Error("Metrics backfill failed")
+		os.Exit(1)
+	}
+}
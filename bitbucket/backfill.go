@@ -0,0 +1,147 @@
+package bitbucket
+
+import (
+	"bitbucket-metrics/metrics"
+	"errors"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics which can be told for any past day from PR, ref change, commit & release tag dates, the rest are only known
+// when collected. Those depending on approvals are left out as only current approvals are known
+var BACKFILL_METRICS = []string{
+	"prs_by_author",
+	"prs_by_reviewer",
+	"review_pairs",
+	"review_gini",
+	"open_prs",
+	"branches_by_author",
+	"tags_by_author",
+	"prs_by_team",
+	"prs_by_reviewer_team",
+	"branches_by_team",
+	"tags_by_team",
+	"pr_throughput",
+	"pr_throughput_by_author",
+	"commits_by_author",
+	"deployments",
+}
+
+// asOf returns the collection as it was at the given time, reviewers & approvals are the currently known ones though
+func (collection *collection) asOf(at time.Time) *collection {
+	past := newCollection()
+	past.identities = collection.identities
+	past.teams = collection.teams
+	for repoKey := range collection.openPRs {
+		past.openPRs[repoKey] = 0
+		past.prsAwaitingReview[repoKey] = 0
+	}
+	for prKey, pr := range collection.prs {
+		if pr.Created.IsZero() || pr.Created.After(at) {
+			continue
+		}
+		closed := pr.Closed
+		if closed.IsZero() {
+			closed = pr.Updated
+		}
+		if pr.State != "OPEN" && closed.After(at) {
+			pr.State = "OPEN"
+		}
+		past.addPR(prKey.project, prKey.repo, pr)
+	}
+	for _, reference := range collection.references {
+		if reference.Reference.Created.IsZero() || reference.Reference.Created.After(at) {
+			continue
+		}
+		past.addReferences(reference.Project, reference.Repo, []Reference{reference.Reference})
+	}
+	return past
+}
+
+// countWindowsAsOf counts the windowed metrics of a collection as they were at the given time into its past one
+func (runner *Runner) countWindowsAsOf(collection *collection, past *collection, at time.Time) {
+	prs := map[ProjectRepoKey][]PR{}
+	for repoKey := range collection.openPRs {
+		prs[repoKey] = nil
+	}
+	for prKey, pr := range past.prs {
+		repoKey := ProjectRepoKey{
+			project: prKey.project,
+			repo:    prKey.repo,
+		}
+		prs[repoKey] = append(prs[repoKey], pr)
+	}
+	for repoKey, repoPRs := range prs {
+		runner.countPRThroughput(repoKey, repoPRs, past, at)
+	}
+	for repoKey, commits := range collection.commits {
+		runner.countCommits(repoKey, commits, past, at, collection.commitsSince)
+	}
+	for repoKey, releases := range collection.releases {
+		runner.countDeployments(repoKey, releases, past, at)
+	}
+}
+
+// Backfill adds to the history a daily snapshot of the last collection as it was since the given day until another one
+func (runner *Runner) Backfill(since time.Time, until time.Time, options metrics.Options, history *metrics.History) error {
+	runner.mutex.Lock()
+	collection := runner.collection
+	runner.mutex.Unlock()
+	if collection == nil {
+		return errors.New("no metrics collection done yet")
+	}
+	var names []string
+	for _, name := range BACKFILL_METRICS {
+		names = append(names, prometheus.BuildFQName(options.Prefix, "", name))
+	}
+	// Collected metrics which can't be told for past days are left out of the backfill
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(runner.metrics.Collectors()...)
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, metricFamily := range metricFamilies {
+		if len(metricFamily.GetMetric()) > 0 && !slices.Contains(names, metricFamily.GetName()) {
+			log.WithFields(log.Fields{
+				"metric": metricFamily.GetName(),
+			}).Warn("Metric not backfilled, it is only known when collected")
+		}
+	}
+	days := 0
+	for day := since; !day.After(until); day = day.AddDate(0, 0, 1) {
+		// Each day is published on its own metrics, so no series is left from former days
+		dayMetrics := metrics.NewMetricsWithOptions(options)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(dayMetrics.Collectors()...)
+		dayRunner := &Runner{
+			config:  runner.config,
+			metrics: dayMetrics,
+		}
+		past := collection.asOf(day)
+		dayRunner.countWindowsAsOf(collection, past, day)
+		dayRunner.publish(past)
+		gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			metricFamilies, err := registry.Gather()
+			return slices.DeleteFunc(metricFamilies, func(metricFamily *dto.MetricFamily) bool {
+				return !slices.Contains(names, metricFamily.GetName())
+			}), err
+		})
+		err := history.Add(gatherer, day)
+		if err != nil {
+			return err
+		}
+		days += 1
+	}
+	log.WithFields(log.Fields{
+		"since": since,
+		"until": until,
+		"days":  days,
+	}).Info("Metrics backfilled")
+	return nil
+}
@@ -1,22 +1,32 @@
 package bitbucket
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"iter"
+	"net/http"
 	"slices"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const API_PATH = "rest/api/latest"
+const BUILD_STATUS_API_PATH = "rest/build-status/latest"
 
 func Init(bitbucketBaseURL, username, password string, apiPageSize int) *Request {
+	return InitWithTransport(bitbucketBaseURL, username, password, apiPageSize, nil)
+}
+
+func InitWithTransport(bitbucketBaseURL, username, password string, apiPageSize int, transport http.RoundTripper) *Request {
 	request, err := NewRequest(bitbucketBaseURL, username, password, apiPageSize)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Panic("Cannot create the request")
 	}
+	request.Transport = transport
 
 	version, err := version(request)
 	if err != nil {
@@ -51,55 +61,83 @@ func version(request *Request) (string, error) {
 	return version, nil
 }
 
-func paginatedValues(request *Request, path string, params map[string]string, valueProcessor func(map[string]any)) error {
-	lastPage := false
-	start := 0
-	for !lastPage {
-		args := map[string]any{
-			"limit": request.PageSize,
-			"start": start,
-		}
-		for name, value := range params {
-			args[name] = value
-		}
-		result, err := request.RunWithArgs("GET", args, API_PATH, path)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Cannot run the request")
-			return err
-		}
-		log.Debugf("Result: %v", result)
-
-		// Parse required fields
-		valuesJSON, okValuesJSON := result["values"].([]any)
-		if okValuesJSON {
-			for _, value := range valuesJSON {
-				valueJSON, okValueJSON := value.(map[string]any)
-				if !okValueJSON {
+func millisToTime(millis int64) time.Time {
+	// Missing Bitbucket timestamps are left as zero time instead of Unix epoch
+	if millis == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(millis)
+}
+
+func versionAtLeast(version string, major, minor int) bool {
+	var versionMajor, versionMinor int
+	_, err := fmt.Sscanf(version, "%d.%d", &versionMajor, &versionMinor)
+	if err != nil {
+		// Unknown versions are considered recent ones
+		return true
+	}
+	return versionMajor > major || (versionMajor == major && versionMinor >= minor)
+}
+
+func Paginate[T any](request *Request, path string, params map[string]string) iter.Seq2[T, error] {
+	return PaginateAPI[T](request, API_PATH, path, params)
+}
+
+func PaginateAPI[T any](request *Request, apiPath string, path string, params map[string]string) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		lastPage := false
+		start := 0
+		for !lastPage {
+			args := map[string]any{
+				"limit": request.PageSize,
+				"start": start,
+			}
+			for name, value := range params {
+				args[name] = value
+			}
+			var page Page[json.RawMessage]
+			err := request.Decode("GET", args, &page, apiPath, path)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"path": path,
+					"err":  err,
+				}).Error("Cannot run the request")
+				var zero T
+				yield(zero, err)
+				return
+			}
+
+			// Decode every value on its own so a bad record does not spoil the whole page
+			for _, rawValue := range page.Values {
+				var value T
+				err := json.Unmarshal(rawValue, &value)
+				if err == nil {
+					if validator, ok := any(value).(interface{ Validate() error }); ok {
+						err = validator.Validate()
+					}
+				}
+				if err != nil {
+					request.decodeFailures.Add(1)
+					log.WithFields(log.Fields{
+						"path":  path,
+						"type":  fmt.Sprintf("%T", value),
+						"json":  string(rawValue),
+						"error": err,
+					}).Warn("Cannot decode record, skipping it")
 					continue
 				}
-				valueProcessor(valueJSON)
+				if !yield(value, nil) {
+					return
+				}
 			}
-		}
 
-		// Check if there are more pages to get
-		var ok bool
-		lastPage, ok = result["isLastPage"].(bool)
-		if !ok {
-			lastPage = true
-		}
-		if !lastPage {
-			// And the next page start offset
-			nextPageStart, ok := result["nextPageStart"].(float64)
-			if !ok {
-				lastPage = true
-			} else {
-				start = int(nextPageStart)
+			// Check if there are more pages to get, and the next page start offset
+			lastPage = page.IsLastPage || page.NextPageStart == nil
+			if !lastPage {
+				start = *page.NextPageStart
 			}
 		}
 	}
-	return nil
 }
 
 type Project struct {
@@ -110,46 +148,85 @@ type Project struct {
 
 func Projects(request *Request, includeProjects []string) (map[string]Project, error) {
 	projects := map[string]Project{}
-	paginatedValues(request, "projects", nil, func(valueJSON map[string]any) {
-		key, okKey := valueJSON["key"].(string)
-		name, okName := valueJSON["name"].(string)
-		description, okDescription := valueJSON["description"].(string)
-		if okKey && okName && okDescription {
-			if includeProjects == nil || slices.Contains(includeProjects, key) {
-				projects[key] = Project{
-					Key:         key,
-					Name:        name,
-					Description: description,
-				}
+	for project, err := range Paginate[ProjectPayload](request, "projects", nil) {
+		if err != nil {
+			return nil, err
+		}
+		if includeProjects == nil || slices.Contains(includeProjects, project.Key) {
+			projects[project.Key] = Project{
+				Key:         project.Key,
+				Name:        project.Name,
+				Description: project.Description,
 			}
 		}
-	})
+	}
 	return projects, nil
 }
 
 type Repo struct {
+	Slug string
 	Name string
 }
 
 func Repos(request *Request, project string) (map[string]Repo, error) {
 	repos := map[string]Repo{}
 	path := fmt.Sprintf("projects/%s/repos", project)
-	paginatedValues(request, path, nil, func(valueJSON map[string]any) {
-		name, okName := valueJSON["name"].(string)
-		if okName {
-			repos[name] = Repo{
-				Name: name,
-			}
+	for repo, err := range Paginate[RepoPayload](request, path, nil) {
+		if err != nil {
+			return nil, err
+		}
+		repos[repo.Name] = Repo{
+			Slug: repo.Slug,
+			Name: repo.Name,
 		}
-	})
+	}
 	return repos, nil
 }
 
 type PR struct {
-	Name      string
-	State     string
-	Author    string
-	Reviewers []string
+	ID           int
+	Created      time.Time
+	Updated      time.Time
+	Closed       time.Time
+	HeadCommit   string
+	MergeCommit  string
+	Target       string
+	Name         string
+	State        string
+	Author       string
+	Reviewers    []string
+	Approvers    []string
+	Participants []string
+}
+
+func NewPR(pr PullRequestPayload) PR {
+	reviewers := []string{}
+	approvers := []string{}
+	for _, reviewer := range pr.Reviewers {
+		reviewers = append(reviewers, reviewer.User.Slug)
+		if reviewer.Approved {
+			approvers = append(approvers, reviewer.User.Slug)
+		}
+	}
+	participants := []string{}
+	for _, participant := range pr.Participants {
+		participants = append(participants, participant.User.Slug)
+	}
+	return PR{
+		ID:           pr.ID,
+		Created:      millisToTime(pr.CreatedDate),
+		Updated:      millisToTime(pr.UpdatedDate),
+		Closed:       millisToTime(pr.ClosedDate),
+		HeadCommit:   pr.FromRef.LatestCommit,
+		MergeCommit:  pr.Properties.MergeCommit.ID,
+		Target:       pr.ToRef.DisplayID,
+		Name:         pr.Title,
+		State:        pr.State,
+		Author:       pr.Author.User.Slug,
+		Reviewers:    reviewers,
+		Approvers:    approvers,
+		Participants: participants,
+	}
 }
 
 func PRs(request *Request, project string, repo string) ([]PR, error) {
@@ -158,118 +235,418 @@ func PRs(request *Request, project string, repo string) ([]PR, error) {
 	params := map[string]string{
 		"state": "ALL",
 	}
-	err := paginatedValues(request, path, params, func(valueJSON map[string]any) {
-		name, okName := valueJSON["title"].(string)
-		state, okState := valueJSON["state"].(string)
-		author, okAuthor := "", false
-		authorStruct, okAuthorStruct := valueJSON["author"].(map[string]any)
-		if okAuthorStruct {
-			user, okUser := authorStruct["user"].(map[string]any)
-			if okUser {
-				author, okAuthor = user["slug"].(string)
-			}
+	for prPayload, err := range Paginate[PullRequestPayload](request, path, params) {
+		if err != nil {
+			return nil, err
 		}
-		reviewers, okReviewers := []string{}, true
-		reviewersStruct, okReviewersStruct := valueJSON["reviewers"].([]any)
-		if !okReviewersStruct {
-			okReviewers = false
-		} else {
-			for _, reviewerUserStruct := range reviewersStruct {
-				reviewerUser, okReviewerUser := reviewerUserStruct.(map[string]any)
-				if !okReviewerUser {
-					okReviewers = false
-				} else {
-					reviewerStruct, reviewerStructOk := reviewerUser["user"].(map[string]any)
-					if !reviewerStructOk {
-						okReviewers = false
-					} else {
-						reviewer, reviewerOk := reviewerStruct["slug"].(string)
-						if !reviewerOk {
-							okReviewers = false
-						} else {
-							reviewers = append(reviewers, reviewer)
-						}
-					}
+		pr := NewPR(prPayload)
+		log.WithFields(log.Fields{
+			"project":   project,
+			"repo":      repo,
+			"id":        pr.ID,
+			"PR":        pr.Name,
+			"state":     pr.State,
+			"author":    pr.Author,
+			"reviewers": pr.Reviewers,
+		}).Debug("PR collected")
+		prs = append(prs, pr)
+	}
+	return prs, nil
+}
+
+type PRSize struct {
+	LinesAdded   int
+	LinesRemoved int
+	FilesChanged int
+}
+
+func (size PRSize) Lines() int {
+	return size.LinesAdded + size.LinesRemoved
+}
+
+func PRDiffStat(request *Request, project string, repo string, id int) (PRSize, error) {
+	path := fmt.Sprintf("projects/%s/repos/%s/pull-requests/%d/diff", project, repo, id)
+	args := map[string]any{
+		"contextLines": 0,
+		"withComments": false,
+	}
+	var diffs DiffsPayload
+	err := request.Decode("GET", args, &diffs, API_PATH, path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"project": project,
+			"repo":    repo,
+			"id":      id,
+			"err":     err,
+		}).Error("Cannot get PR diff")
+		return PRSize{}, err
+	}
+	size := PRSize{
+		FilesChanged: len(diffs.Diffs),
+	}
+	truncated := diffs.Truncated
+	for _, diff := range diffs.Diffs {
+		truncated = truncated || diff.Truncated
+		for _, hunk := range diff.Hunks {
+			truncated = truncated || hunk.Truncated
+			for _, segment := range hunk.Segments {
+				switch segment.Type {
+				case "ADDED":
+					size.LinesAdded += len(segment.Lines)
+				case "REMOVED":
+					size.LinesRemoved += len(segment.Lines)
 				}
 			}
 		}
-		if okName && okState && okAuthor && okReviewers {
-			log.WithFields(log.Fields{
-				"project":   project,
-				"repo":      repo,
-				"PR":        name,
-				"state":     state,
-				"author":    author,
-				"reviewers": reviewers,
-			}).Debug("PR collected")
-			prs = append(prs, PR{
-				Name:      name,
-				State:     state,
-				Author:    author,
-				Reviewers: reviewers,
-			})
+	}
+	if truncated {
+		log.WithFields(log.Fields{
+			"project": project,
+			"repo":    repo,
+			"id":      id,
+		}).Warn("PR diff is truncated, its size is a lower bound")
+	}
+	log.WithFields(log.Fields{
+		"project":       project,
+		"repo":          repo,
+		"id":            id,
+		"lines-added":   size.LinesAdded,
+		"lines-removed": size.LinesRemoved,
+		"files-changed": size.FilesChanged,
+	}).Debug("PR size collected")
+	return size, nil
+}
+
+type Comment struct {
+	ID     int
+	Author string
+}
+
+func PRComments(request *Request, project string, repo string, id int) ([]Comment, error) {
+	var comments []Comment
+	seen := map[int]bool{}
+	var addComment func(comment CommentPayload)
+	addComment = func(comment CommentPayload) {
+		if seen[comment.ID] {
+			return
+		}
+		seen[comment.ID] = true
+		// Blocker comments are tasks, so they are counted apart
+		if comment.Severity != "BLOCKER" {
+			if err := comment.Validate(); err == nil {
+				comments = append(comments, Comment{
+					ID:     comment.ID,
+					Author: comment.Author.Slug,
+				})
+			}
+		}
+		for _, reply := range comment.Comments {
+			addComment(reply)
 		}
-	})
-	if err != nil {
-		return nil, err
 	}
-	return prs, nil
+	path := fmt.Sprintf("projects/%s/repos/%s/pull-requests/%d/activities", project, repo, id)
+	for activity, err := range Paginate[PullRequestActivityPayload](request, path, nil) {
+		if err != nil {
+			return nil, err
+		}
+		if activity.Action == "COMMENTED" && activity.Comment != nil {
+			addComment(*activity.Comment)
+		}
+	}
+	log.WithFields(log.Fields{
+		"project":  project,
+		"repo":     repo,
+		"id":       id,
+		"comments": len(comments),
+	}).Debug("PR comments collected")
+	return comments, nil
+}
+
+type Task struct {
+	ID    int
+	State string
+}
+
+func PRTasks(request *Request, project string, repo string, id int) ([]Task, error) {
+	var tasks []Task
+	// Since Bitbucket 7.2 tasks are blocker comments
+	endpoint := "blocker-comments"
+	if !versionAtLeast(request.BitbucketVersion, 7, 2) {
+		endpoint = "tasks"
+	}
+	path := fmt.Sprintf("projects/%s/repos/%s/pull-requests/%d/%s", project, repo, id, endpoint)
+	for task, err := range Paginate[TaskPayload](request, path, nil) {
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, Task{
+			ID:    task.ID,
+			State: task.State,
+		})
+	}
+	log.WithFields(log.Fields{
+		"project": project,
+		"repo":    repo,
+		"id":      id,
+		"tasks":   len(tasks),
+	}).Debug("PR tasks collected")
+	return tasks, nil
 }
 
 type Reference struct {
-	Name   string
-	Author string
+	Name       string
+	Type       string
+	ChangeType string
+	Commit     string
+	Author     string
+	Created    time.Time
 }
 
 func References(request *Request, project string, repo string) ([]Reference, []Reference, error) {
 	var branches, tags []Reference
 	path := fmt.Sprintf("projects/%s/repos/%s/ref-change-activities", project, repo)
-	err := paginatedValues(request, path, nil, func(valueJSON map[string]any) {
-		author, okAuthor := "", false
-		authorStruct, okAuthorStruct := valueJSON["user"].(map[string]any)
-		if okAuthorStruct {
-			author, okAuthor = authorStruct["name"].(string)
+	for activity, err := range Paginate[RefChangeActivityPayload](request, path, nil) {
+		if err != nil {
+			return nil, nil, err
 		}
-		refName, okRefName := "", false
-		refType, okRefType := "", false
-		refChangeStruct, okRefChangeStruct := valueJSON["refChange"].(map[string]any)
-		if okRefChangeStruct {
-			refStruct, okRefStruct := refChangeStruct["ref"].(map[string]any)
-			if okRefStruct {
-				refName, okRefName = refStruct["displayId"].(string)
-				refType, okRefType = refStruct["type"].(string)
-			}
+		refName := activity.RefChange.Ref.DisplayID
+		refType := activity.RefChange.Ref.Type
+		author := activity.User.Name
+		log.WithFields(log.Fields{
+			"project":   project,
+			"repo":      repo,
+			"reference": refName,
+			"type":      refType,
+			"author":    author,
+		}).Debug("Reference collected")
+		reference := Reference{
+			Name:       refName,
+			Type:       refType,
+			ChangeType: activity.RefChange.Type,
+			Commit:     activity.RefChange.ToHash,
+			Author:     author,
+			Created:    millisToTime(activity.CreatedDate),
 		}
-		if okAuthor && okRefName && okRefType {
+		switch refType {
+		case "BRANCH":
+			branches = append(branches, reference)
+		case "TAG":
+			tags = append(tags, reference)
+		default:
 			log.WithFields(log.Fields{
 				"project":   project,
 				"repo":      repo,
 				"reference": refName,
 				"type":      refType,
 				"author":    author,
-			}).Debug("Reference collected")
-			reference := Reference{
-				Name:   refName,
-				Author: author,
-			}
-			switch refType {
-			case "BRANCH":
-				branches = append(branches, reference)
-			case "TAG":
-				tags = append(tags, reference)
-			default:
-				log.WithFields(log.Fields{
-					"project":   project,
-					"repo":      repo,
-					"reference": refName,
-					"type":      refType,
-					"author":    author,
-				}).Error("Reference of unknown type")
-			}
+			}).Error("Reference of unknown type")
 		}
-	})
-	if err != nil {
-		return nil, nil, err
 	}
 	return branches, tags, nil
 }
+
+type Commit struct {
+	ID        string
+	Author    string
+	Timestamp time.Time
+}
+
+func Commits(request *Request, project string, repo string, since string, notBefore time.Time) ([]Commit, error) {
+	var commits []Commit
+	path := fmt.Sprintf("projects/%s/repos/%s/commits", project, repo)
+	var params map[string]string
+	if since != "" {
+		params = map[string]string{
+			"since": since,
+		}
+	}
+	for commit, err := range Paginate[CommitPayload](request, path, params) {
+		if err != nil {
+			return nil, err
+		}
+		// Commits come newest first by when they were committed, which rebased ones were authored long before,
+		// so windows go by committer timestamp both to stop walking the history & to count commits
+		committed := time.UnixMilli(commit.CommitterTimestamp)
+		if committed.Before(notBefore) {
+			break
+		}
+		// Authors not linked to a Bitbucket user only have their Git name
+		author := commit.Author.Slug
+		if author == "" {
+			author = commit.Author.Name
+		}
+		log.WithFields(log.Fields{
+			"project": project,
+			"repo":    repo,
+			"commit":  commit.DisplayID,
+			"author":  author,
+		}).Debug("Commit collected")
+		commits = append(commits, Commit{
+			ID:        commit.ID,
+			Author:    author,
+			Timestamp: committed,
+		})
+	}
+	return commits, nil
+}
+
+// ContainsCommit tells whether a commit is reachable from another one (like a tag), that is, whether no commit
+// reachable from the former is missing from the latter
+func ContainsCommit(request *Request, project string, repo string, from string, commit string) (bool, error) {
+	args := map[string]any{
+		"since": from,
+		"until": commit,
+		"limit": 1,
+	}
+	var page Page[json.RawMessage]
+	err := request.Decode("GET", args, &page, API_PATH, fmt.Sprintf("projects/%s/repos/%s/commits", project, repo))
+	if err != nil {
+		return false, err
+	}
+	return len(page.Values) == 0, nil
+}
+
+// PRFirstCommit returns when the oldest commit of a PR was authored
+func PRFirstCommit(request *Request, project string, repo string, id int) (time.Time, error) {
+	var first time.Time
+	path := fmt.Sprintf("projects/%s/repos/%s/pull-requests/%d/commits", project, repo, id)
+	for commit, err := range Paginate[CommitPayload](request, path, nil) {
+		if err != nil {
+			return time.Time{}, err
+		}
+		authored := millisToTime(commit.AuthorTimestamp)
+		if first.IsZero() || authored.Before(first) {
+			first = authored
+		}
+	}
+	return first, nil
+}
+
+func DefaultBranch(request *Request, project string, repo string) (string, error) {
+	path := fmt.Sprintf("projects/%s/repos/%s/branches/default", project, repo)
+	var branch RefPayload
+	err := request.Decode("GET", nil, &branch, API_PATH, path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"project": project,
+			"repo":    repo,
+			"err":     err,
+		}).Error("Cannot get default branch")
+		return "", err
+	}
+	return branch.DisplayID, nil
+}
+
+func LatestCommit(request *Request, project string, repo string) (string, error) {
+	path := fmt.Sprintf("projects/%s/repos/%s/commits", project, repo)
+	args := map[string]any{
+		"limit": 1,
+	}
+	var page Page[CommitPayload]
+	err := request.Decode("GET", args, &page, API_PATH, path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"project": project,
+			"repo":    repo,
+			"err":     err,
+		}).Error("Cannot get latest commit")
+		return "", err
+	}
+	if len(page.Values) == 0 {
+		// Empty repository
+		return "", nil
+	}
+	return page.Values[0].ID, nil
+}
+
+type Build struct {
+	Key   string
+	State string
+}
+
+func Builds(request *Request, project string, repo string, commit string) ([]Build, error) {
+	var builds []Build
+	latestBuilds := map[string]BuildStatusPayload{}
+	// Since Bitbucket 7.14 builds are scoped to the repository, before only the legacy build status API is there
+	apiPath := API_PATH
+	path := fmt.Sprintf("projects/%s/repos/%s/commits/%s/builds", project, repo, commit)
+	if !versionAtLeast(request.BitbucketVersion, 7, 14) {
+		apiPath = BUILD_STATUS_API_PATH
+		path = fmt.Sprintf("commits/%s", commit)
+	}
+	for build, err := range PaginateAPI[BuildStatusPayload](request, apiPath, path, nil) {
+		if err != nil {
+			return nil, err
+		}
+		// Keep only the latest status reported for each build key
+		if latestBuild, ok := latestBuilds[build.Key]; ok && latestBuild.Updated() > build.Updated() {
+			continue
+		}
+		latestBuilds[build.Key] = build
+	}
+	for _, build := range latestBuilds {
+		builds = append(builds, Build{
+			Key:   build.Key,
+			State: build.State,
+		})
+	}
+	log.WithFields(log.Fields{
+		"project": project,
+		"repo":    repo,
+		"commit":  commit,
+		"builds":  builds,
+	}).Debug("Builds collected")
+	return builds, nil
+}
+
+type User struct {
+	Slug        string
+	Name        string
+	DisplayName string
+	Email       string
+	Active      bool
+	Type        string
+}
+
+func Users(request *Request) ([]User, error) {
+	var users []User
+	for user, err := range Paginate[UserPayload](request, "users", nil) {
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, User{
+			Slug:        user.Slug,
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+			Email:       user.EmailAddress,
+			Active:      user.Active,
+			Type:        user.Type,
+		})
+	}
+	log.WithFields(log.Fields{
+		"users": len(users),
+	}).Debug("Users collected")
+	return users, nil
+}
+
+func GroupMembers(request *Request, group string) ([]string, error) {
+	var members []string
+	params := map[string]string{
+		"context": group,
+	}
+	for user, err := range Paginate[UserPayload](request, "admin/groups/more-members", params) {
+		if err != nil {
+			return nil, err
+		}
+		// Persons are labeled by slug on PRs but by name on references, so both are members
+		members = append(members, user.Slug)
+		if user.Name != "" && user.Name != user.Slug {
+			members = append(members, user.Name)
+		}
+	}
+	log.WithFields(log.Fields{
+		"group":   group,
+		"members": members,
+	}).Debug("Group members collected")
+	return members, nil
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestInitWithValidVersion(t *testing.T) {
@@ -80,3 +81,267 @@ func TestInitWithValidResponseButNoVersion(t *testing.T) {
 
 	Init(ts.URL, "username", "password", 123)
 }
+
+func TestPaginateFollowsPagesAndSkipsInvalidRecords(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/projects", API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		if r.URL.Query().Get("limit") != "2" {
+			t.Errorf("Invalid limit '%v', expected '2'", r.URL.Query().Get("limit"))
+		}
+		switch r.URL.Query().Get("start") {
+		case "0":
+			w.Write([]byte(`{"isLastPage": false, "nextPageStart": 2, "values": [` +
+				`{"key": "P1", "name": "Project 1"}, {"key": 2, "name": "Bad type"}]}`))
+		case "2":
+			w.Write([]byte(`{"isLastPage": true, "values": [` +
+				`{"key": "P3", "name": "Project 3"}, {"key": "P4"}]}`))
+		default:
+			t.Errorf("Unexpected start '%v'", r.URL.Query().Get("start"))
+		}
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 2)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	var keys []string
+	for project, err := range Paginate[ProjectPayload](req, "projects", nil) {
+		if err != nil {
+			t.Fatalf("Paginate failed with error: %v", err)
+		}
+		keys = append(keys, project.Key)
+	}
+	if len(keys) != 2 || keys[0] != "P1" || keys[1] != "P3" {
+		t.Errorf("Unexpected decoded projects %v, expected [P1 P3]", keys)
+	}
+	if req.DecodeFailures() != 2 {
+		t.Errorf("Unexpected decode failures %v, expected 2", req.DecodeFailures())
+	}
+}
+
+func TestPaginateStopsOnRequestError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 2)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	_, err = Projects(req, nil)
+	if err == nil {
+		t.Error("Projects should return error when the server fails")
+	}
+}
+
+func TestPRsSkipsPRsWithoutAuthor(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/projects/P1/repos/repo-1/pull-requests", API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		if r.URL.Query().Get("state") != "ALL" {
+			t.Errorf("Invalid state '%v', expected 'ALL'", r.URL.Query().Get("state"))
+		}
+		w.Write([]byte(`{"isLastPage": true, "values": [` +
+			`{"id": 1, "title": "PR 1", "state": "OPEN", "author": {"user": {"slug": "alice"}}, "fromRef": {"latestCommit": "abc"}, ` +
+			`"reviewers": [{"user": {"slug": "bob"}}]}, ` +
+			`{"id": 2, "title": "PR 2", "state": "MERGED", "author": {"user": {}}}]}`))
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	prs, err := PRs(req, "P1", "repo-1")
+	if err != nil {
+		t.Fatalf("PRs failed with error: %v", err)
+	}
+	if len(prs) != 1 {
+		t.Fatalf("Unexpected PRs count %v, expected 1", len(prs))
+	}
+	if prs[0].Name != "PR 1" || prs[0].HeadCommit != "abc" || prs[0].Author != "alice" || len(prs[0].Reviewers) != 1 || prs[0].Reviewers[0] != "bob" {
+		t.Errorf("Unexpected PR %+v", prs[0])
+	}
+	if req.DecodeFailures() != 1 {
+		t.Errorf("Unexpected decode failures %v, expected 1", req.DecodeFailures())
+	}
+}
+
+func TestCommitsSinceWatermarkAndStopsOutOfWindow(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-time.Hour).UnixMilli()
+	old := now.AddDate(0, 0, -10).UnixMilli()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/projects/P1/repos/repo-1/commits", API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		if r.URL.Query().Get("since") != "abc" {
+			t.Errorf("Invalid since '%v', expected 'abc'", r.URL.Query().Get("since"))
+		}
+		fmt.Fprintf(w, `{"isLastPage": false, "nextPageStart": 3, "values": [`+
+			`{"id": "c3", "author": {"name": "Alice", "slug": "alice"}, "authorTimestamp": %[1]d, "committerTimestamp": %[1]d}, `+
+			`{"id": "c2", "author": {"name": "Git Bob"}, "authorTimestamp": %[2]d, "committerTimestamp": %[1]d}, `+
+			`{"id": "c1", "author": {"name": "Alice", "slug": "alice"}, "authorTimestamp": %[2]d, "committerTimestamp": %[2]d}]}`,
+			recent, old)
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 3)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	commits, err := Commits(req, "P1", "repo-1", "abc", now.AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatalf("Commits failed with error: %v", err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("Unexpected commits count %v, expected 2", len(commits))
+	}
+	if commits[0].ID != "c3" || commits[0].Author != "alice" {
+		t.Errorf("Unexpected first commit %+v", commits[0])
+	}
+	// A rebased commit counts when it was committed, not when it was authored
+	if commits[1].ID != "c2" || commits[1].Author != "Git Bob" || commits[1].Timestamp.UnixMilli() != recent {
+		t.Errorf("Unexpected second commit %+v", commits[1])
+	}
+}
+
+func TestPRDiffStatCountsLinesAndFiles(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/projects/P1/repos/repo-1/pull-requests/7/diff", API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		if r.URL.Query().Get("contextLines") != "0" {
+			t.Errorf("Invalid context lines '%v', expected '0'", r.URL.Query().Get("contextLines"))
+		}
+		w.Write([]byte(`{"diffs": [` +
+			`{"hunks": [{"segments": [{"type": "REMOVED", "lines": [{}, {}]}, {"type": "ADDED", "lines": [{}, {}, {}]}]}]}, ` +
+			`{"hunks": [{"segments": [{"type": "CONTEXT", "lines": [{}]}, {"type": "ADDED", "lines": [{}]}]}]}]}`))
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	size, err := PRDiffStat(req, "P1", "repo-1", 7)
+	if err != nil {
+		t.Fatalf("PRDiffStat failed with error: %v", err)
+	}
+	if size.LinesAdded != 4 || size.LinesRemoved != 2 || size.FilesChanged != 2 || size.Lines() != 6 {
+		t.Errorf("Unexpected PR size %+v", size)
+	}
+}
+
+func TestPRCommentsFlattensRepliesWithoutTasks(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/projects/P1/repos/repo-1/pull-requests/7/activities", API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		w.Write([]byte(`{"isLastPage": true, "values": [` +
+			`{"id": 1, "action": "OPENED"}, ` +
+			`{"id": 2, "action": "COMMENTED", "comment": {"id": 10, "author": {"slug": "bob"}, "comments": [` +
+			`{"id": 11, "author": {"slug": "alice"}}, {"id": 12, "severity": "BLOCKER", "author": {"slug": "bob"}}]}}, ` +
+			`{"id": 3, "action": "COMMENTED", "comment": {"id": 11, "author": {"slug": "alice"}}}]}`))
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	comments, err := PRComments(req, "P1", "repo-1", 7)
+	if err != nil {
+		t.Fatalf("PRComments failed with error: %v", err)
+	}
+	if len(comments) != 2 || comments[0].Author != "bob" || comments[1].Author != "alice" {
+		t.Errorf("Unexpected comments %+v", comments)
+	}
+}
+
+func TestPRTasksEndpointDependsOnVersion(t *testing.T) {
+	for version, endpoint := range map[string]string{"7.1.0": "tasks", "7.2.0": "blocker-comments", "8.19.1": "blocker-comments"} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expectedPath := fmt.Sprintf("/%s/projects/P1/repos/repo-1/pull-requests/7/%s", API_PATH, endpoint)
+			if r.URL.Path != expectedPath {
+				t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+			}
+			w.Write([]byte(`{"isLastPage": true, "values": [{"id": 1, "state": "OPEN"}, {"id": 2, "state": "RESOLVED"}]}`))
+		}))
+
+		req, err := NewRequest(ts.URL, "username", "password", 100)
+		if err != nil {
+			t.Fatalf("NewRequest failed with error: %v", err)
+		}
+		req.BitbucketVersion = version
+		tasks, err := PRTasks(req, "P1", "repo-1", 7)
+		if err != nil {
+			t.Errorf("PRTasks failed with error: %v", err)
+		}
+		if len(tasks) != 2 || tasks[0].State != "OPEN" || tasks[1].State != "RESOLVED" {
+			t.Errorf("Unexpected tasks %+v", tasks)
+		}
+		ts.Close()
+	}
+}
+
+func TestBuildsKeepsLatestStatusByKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/projects/P1/repos/repo-1/commits/abc/builds", API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		w.Write([]byte(`{"isLastPage": true, "values": [` +
+			`{"key": "ci", "state": "FAILED", "updatedDate": 1}, ` +
+			`{"key": "ci", "state": "SUCCESSFUL", "updatedDate": 2}]}`))
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	builds, err := Builds(req, "P1", "repo-1", "abc")
+	if err != nil {
+		t.Fatalf("Builds failed with error: %v", err)
+	}
+	if len(builds) != 1 || builds[0].Key != "ci" || builds[0].State != "SUCCESSFUL" {
+		t.Errorf("Unexpected builds %+v", builds)
+	}
+}
+
+func TestBuildsFallBackToLegacyAPI(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expectedPath := fmt.Sprintf("/%s/commits/abc", BUILD_STATUS_API_PATH)
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		w.Write([]byte(`{"isLastPage": true, "values": [` +
+			`{"key": "ci", "state": "SUCCESSFUL", "dateAdded": 2}, ` +
+			`{"key": "ci", "state": "FAILED", "dateAdded": 1}]}`))
+	}))
+	defer ts.Close()
+
+	req, err := NewRequest(ts.URL, "username", "password", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	req.BitbucketVersion = "7.13.0"
+	builds, err := Builds(req, "P1", "repo-1", "abc")
+	if err != nil {
+		t.Fatalf("Builds failed with error: %v", err)
+	}
+	if len(builds) != 1 || builds[0].Key != "ci" || builds[0].State != "SUCCESSFUL" {
+		t.Errorf("Unexpected builds %+v", builds)
+	}
+}
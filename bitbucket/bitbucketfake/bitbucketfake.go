@@ -0,0 +1,720 @@
+// Package bitbucketfake is an in-process fake Bitbucket Data Center server for tests.
+//
+// It models projects, repositories, pull requests with their participants, ref
+// change activities, users and groups in memory, serves them through the same REST paths and
+// pagination as Bitbucket Data Center and allows injecting faults.
+package bitbucketfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const API_PATH = "/rest/api/latest"
+
+const DEFAULT_PAGE_LIMIT = 25
+
+type User struct {
+	Name        string
+	Slug        string
+	DisplayName string
+	Email       string
+	Service     bool
+}
+
+type Participant struct {
+	User     User
+	Approved bool
+}
+
+type PR struct {
+	ID           int
+	Title        string
+	State        string
+	Author       User
+	Reviewers    []Participant
+	Participants []Participant
+	HeadCommit   string
+	MergeCommit  string
+	// Target branch, main by default
+	Target  string
+	Commits []Commit
+	// Lines added to a single file by the diff, none when 0
+	LinesAdded int
+	Created    time.Time
+	Updated    time.Time
+	Closed     time.Time
+}
+
+type Commit struct {
+	ID       string
+	Author   User
+	Authored time.Time
+	// Parent commits, the previous one of the repo when empty
+	Parents []string
+}
+
+type RefChange struct {
+	User    User
+	Ref     string
+	RefType string
+	Type    string
+	Commit  string
+	Created time.Time
+}
+
+type Repo struct {
+	Slug          string
+	Name          string
+	DefaultBranch string
+	PRs           []*PR
+	RefChanges    []RefChange
+	// Default branch commits, oldest first
+	Commits []Commit
+}
+
+type Project struct {
+	Key         string
+	Name        string
+	Description string
+	Repos       []*Repo
+}
+
+type Fault struct {
+	// Requests whose path contains Path are affected, all of them when empty
+	Path string
+	// Status code to answer with instead of the real response, none when 0
+	Status int
+	// Delay before answering
+	Delay time.Duration
+	// Number of requests affected, all of them when 0
+	Times int
+}
+
+type Server struct {
+	Version string
+
+	mutex    sync.Mutex
+	server   *httptest.Server
+	projects []*Project
+	users    []User
+	groups   map[string][]User
+	faults   []*Fault
+	requests []string
+}
+
+func NewServer() *Server {
+	server := &Server{
+		Version: "8.19.0",
+		groups:  map[string][]User{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+API_PATH+"/application-properties", server.applicationProperties)
+	mux.HandleFunc("GET "+API_PATH+"/users", server.listUsers)
+	mux.HandleFunc("GET "+API_PATH+"/admin/groups/more-members", server.listGroupMembers)
+	mux.HandleFunc("GET "+API_PATH+"/projects", server.listProjects)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos", server.listRepos)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/pull-requests", server.listPRs)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/pull-requests/{id}", server.getPR)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/pull-requests/{id}/commits", server.listPRCommits)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/pull-requests/{id}/diff", server.getPRDiff)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/pull-requests/{id}/activities", server.listPRComments)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/pull-requests/{id}/blocker-comments", server.listPRComments)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/commits", server.listCommits)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/ref-change-activities", server.listRefChanges)
+	mux.HandleFunc("GET "+API_PATH+"/projects/{project}/repos/{repo}/branches/default", server.getDefaultBranch)
+	server.server = httptest.NewServer(server.withFaults(mux))
+	return server
+}
+
+func (server *Server) URL() string {
+	return server.server.URL
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+func (server *Server) AddProject(key, name string) *Project {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	project := &Project{
+		Key:  key,
+		Name: name,
+	}
+	server.projects = append(server.projects, project)
+	return project
+}
+
+func (server *Server) AddUser(users ...User) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.users = append(server.users, users...)
+}
+
+func (server *Server) AddGroup(name string, members ...User) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.groups[name] = append(server.groups[name], members...)
+}
+
+func (project *Project) AddRepo(slug, name string) *Repo {
+	repo := &Repo{
+		Slug:          slug,
+		Name:          name,
+		DefaultBranch: "main",
+	}
+	project.Repos = append(project.Repos, repo)
+	return repo
+}
+
+func (repo *Repo) AddPR(pr PR) *PR {
+	if pr.ID == 0 {
+		pr.ID = len(repo.PRs) + 1
+	}
+	if pr.State == "" {
+		pr.State = "OPEN"
+	}
+	if pr.Target == "" {
+		pr.Target = "main"
+	}
+	repo.PRs = append(repo.PRs, &pr)
+	return &pr
+}
+
+func (repo *Repo) AddRefChange(refChange RefChange) {
+	if refChange.RefType == "" {
+		refChange.RefType = "BRANCH"
+	}
+	if refChange.Type == "" {
+		refChange.Type = "ADD"
+	}
+	repo.RefChanges = append(repo.RefChanges, refChange)
+}
+
+func (repo *Repo) AddCommit(commits ...Commit) {
+	repo.Commits = append(repo.Commits, commits...)
+}
+
+func (server *Server) InjectFault(fault Fault) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.faults = append(server.faults, &fault)
+}
+
+// Requests returns how many requests were received whose path contains the given one.
+func (server *Server) Requests(path string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	count := 0
+	for _, request := range server.requests {
+		if strings.Contains(request, path) {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (server *Server) withFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		server.requests = append(server.requests, r.URL.Path)
+		var fault *Fault
+		for _, candidate := range server.faults {
+			if strings.Contains(r.URL.Path, candidate.Path) && candidate.Times >= 0 {
+				fault = candidate
+				if candidate.Times > 0 {
+					candidate.Times -= 1
+					if candidate.Times == 0 {
+						// Exhausted faults are never applied again
+						candidate.Times = -1
+					}
+				}
+				break
+			}
+		}
+		server.mutex.Unlock()
+
+		if fault != nil {
+			if fault.Delay > 0 {
+				select {
+				case <-time.After(fault.Delay):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if fault.Status != 0 {
+				if fault.Status == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "1")
+				}
+				writeJSON(w, fault.Status, map[string]any{
+					"errors": []map[string]any{{"message": http.StatusText(fault.Status)}},
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func notFound(w http.ResponseWriter, message string) {
+	writeJSON(w, http.StatusNotFound, map[string]any{
+		"errors": []map[string]any{{"message": message}},
+	})
+}
+
+func writePage[T any](w http.ResponseWriter, r *http.Request, values []T) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = DEFAULT_PAGE_LIMIT
+	}
+	start, err := strconv.Atoi(r.URL.Query().Get("start"))
+	if err != nil || start < 0 {
+		start = 0
+	}
+	end := min(start+limit, len(values))
+	pageValues := []T{}
+	if start < len(values) {
+		pageValues = values[start:end]
+	}
+	page := map[string]any{
+		"size":       len(pageValues),
+		"limit":      limit,
+		"start":      start,
+		"isLastPage": end >= len(values),
+		"values":     pageValues,
+	}
+	if end < len(values) {
+		page["nextPageStart"] = end
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func millis(date time.Time) int64 {
+	if date.IsZero() {
+		return 0
+	}
+	return date.UnixMilli()
+}
+
+func (server *Server) findRepo(r *http.Request) (*Project, *Repo) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, project := range server.projects {
+		if project.Key != r.PathValue("project") {
+			continue
+		}
+		if r.PathValue("repo") == "" {
+			return project, nil
+		}
+		for _, repo := range project.Repos {
+			if repo.Slug == r.PathValue("repo") {
+				return project, repo
+			}
+		}
+		return project, nil
+	}
+	return nil, nil
+}
+
+func (server *Server) applicationProperties(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":     server.Version,
+		"buildNumber": strings.ReplaceAll(server.Version, ".", ""),
+		"displayName": "Bitbucket",
+	})
+}
+
+func (server *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	var values []map[string]any
+	for _, user := range server.users {
+		values = append(values, userJSON(user))
+	}
+	server.mutex.Unlock()
+	writePage(w, r, values)
+}
+
+func (server *Server) listGroupMembers(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("context")
+	server.mutex.Lock()
+	members, ok := server.groups[group]
+	var values []map[string]any
+	for _, member := range members {
+		values = append(values, userJSON(member))
+	}
+	server.mutex.Unlock()
+	if !ok {
+		notFound(w, fmt.Sprintf("Group %s does not exist", group))
+		return
+	}
+	writePage(w, r, values)
+}
+
+func projectJSON(project *Project) map[string]any {
+	return map[string]any{
+		"key":         project.Key,
+		"name":        project.Name,
+		"description": project.Description,
+		"type":        "NORMAL",
+	}
+}
+
+func (server *Server) listProjects(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	var values []map[string]any
+	for _, project := range server.projects {
+		values = append(values, projectJSON(project))
+	}
+	server.mutex.Unlock()
+	writePage(w, r, values)
+}
+
+func repoJSON(project *Project, repo *Repo) map[string]any {
+	return map[string]any{
+		"slug":    repo.Slug,
+		"name":    repo.Name,
+		"state":   "AVAILABLE",
+		"project": projectJSON(project),
+	}
+}
+
+func (server *Server) listRepos(w http.ResponseWriter, r *http.Request) {
+	project, _ := server.findRepo(r)
+	if project == nil {
+		notFound(w, fmt.Sprintf("Project %s does not exist", r.PathValue("project")))
+		return
+	}
+	server.mutex.Lock()
+	var values []map[string]any
+	for _, repo := range project.Repos {
+		values = append(values, repoJSON(project, repo))
+	}
+	server.mutex.Unlock()
+	writePage(w, r, values)
+}
+
+func userJSON(user User) map[string]any {
+	userType := "NORMAL"
+	if user.Service {
+		userType = "SERVICE"
+	}
+	return map[string]any{
+		"name":         user.Name,
+		"slug":         user.Slug,
+		"displayName":  user.DisplayName,
+		"emailAddress": user.Email,
+		"active":       true,
+		"type":         userType,
+	}
+}
+
+func participantsJSON(participants []Participant, role string) []map[string]any {
+	values := []map[string]any{}
+	for _, participant := range participants {
+		status := "UNAPPROVED"
+		if participant.Approved {
+			status = "APPROVED"
+		}
+		values = append(values, map[string]any{
+			"user":     userJSON(participant.User),
+			"role":     role,
+			"approved": participant.Approved,
+			"status":   status,
+		})
+	}
+	return values
+}
+
+func prJSON(project *Project, repo *Repo, pr *PR) map[string]any {
+	repository := repoJSON(project, repo)
+	properties := map[string]any{}
+	// Just merged PRs have a merge commit
+	if pr.MergeCommit != "" {
+		properties["mergeCommit"] = map[string]any{
+			"id":        pr.MergeCommit,
+			"displayId": pr.MergeCommit[:min(len(pr.MergeCommit), 11)],
+		}
+	}
+	return map[string]any{
+		"id":          pr.ID,
+		"version":     0,
+		"title":       pr.Title,
+		"state":       pr.State,
+		"open":        pr.State == "OPEN",
+		"closed":      pr.State != "OPEN",
+		"createdDate": millis(pr.Created),
+		"updatedDate": millis(pr.Updated),
+		"closedDate":  millis(pr.Closed),
+		"fromRef": map[string]any{
+			"id":           "refs/heads/feature",
+			"displayId":    "feature",
+			"latestCommit": pr.HeadCommit,
+			"repository":   repository,
+		},
+		"toRef": map[string]any{
+			"id":         "refs/heads/" + pr.Target,
+			"displayId":  pr.Target,
+			"repository": repository,
+		},
+		"author": map[string]any{
+			"user":     userJSON(pr.Author),
+			"role":     "AUTHOR",
+			"approved": false,
+			"status":   "UNAPPROVED",
+		},
+		"reviewers":    participantsJSON(pr.Reviewers, "REVIEWER"),
+		"participants": participantsJSON(pr.Participants, "PARTICIPANT"),
+		"properties":   properties,
+	}
+}
+
+func (server *Server) listPRs(w http.ResponseWriter, r *http.Request) {
+	project, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	// Like Bitbucket, only open PRs are listed by default
+	state := strings.ToUpper(r.URL.Query().Get("state"))
+	if state == "" {
+		state = "OPEN"
+	}
+	server.mutex.Lock()
+	var values []map[string]any
+	// Newest PRs first
+	for i := len(repo.PRs) - 1; i >= 0; i-- {
+		pr := repo.PRs[i]
+		if state == "ALL" || state == pr.State {
+			values = append(values, prJSON(project, repo, pr))
+		}
+	}
+	server.mutex.Unlock()
+	writePage(w, r, values)
+}
+
+func (server *Server) getPR(w http.ResponseWriter, r *http.Request) {
+	project, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, pr := range repo.PRs {
+		if err == nil && pr.ID == id {
+			writeJSON(w, http.StatusOK, prJSON(project, repo, pr))
+			return
+		}
+	}
+	notFound(w, fmt.Sprintf("Pull request %s does not exist", r.PathValue("id")))
+}
+
+func (server *Server) listPRCommits(w http.ResponseWriter, r *http.Request) {
+	_, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	var pr *PR
+	for _, candidate := range repo.PRs {
+		if err == nil && candidate.ID == id {
+			pr = candidate
+		}
+	}
+	if pr == nil {
+		notFound(w, fmt.Sprintf("Pull request %s does not exist", r.PathValue("id")))
+		return
+	}
+	writePage(w, r, commitsJSON(pr.Commits))
+}
+
+func (server *Server) getPRDiff(w http.ResponseWriter, r *http.Request) {
+	_, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, pr := range repo.PRs {
+		if err == nil && pr.ID == id {
+			diffs := []map[string]any{}
+			if pr.LinesAdded > 0 {
+				lines := make([]map[string]any, pr.LinesAdded)
+				for i := range lines {
+					lines[i] = map[string]any{"destination": i + 1}
+				}
+				diffs = append(diffs, map[string]any{
+					"hunks": []map[string]any{{
+						"segments": []map[string]any{{"type": "ADDED", "lines": lines}},
+					}},
+				})
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"diffs": diffs})
+			return
+		}
+	}
+	notFound(w, fmt.Sprintf("Pull request %s does not exist", r.PathValue("id")))
+}
+
+// listPRComments serves PR activities & blocker comments, which aren't modeled so PRs have none
+func (server *Server) listPRComments(w http.ResponseWriter, r *http.Request) {
+	_, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, pr := range repo.PRs {
+		if err == nil && pr.ID == id {
+			writePage(w, r, []map[string]any{})
+			return
+		}
+	}
+	notFound(w, fmt.Sprintf("Pull request %s does not exist", r.PathValue("id")))
+}
+
+// commitsJSON lists commits newest first like Bitbucket does
+func commitsJSON(commits []Commit) []map[string]any {
+	var values []map[string]any
+	for i := len(commits) - 1; i >= 0; i-- {
+		commit := commits[i]
+		values = append(values, map[string]any{
+			"id":                 commit.ID,
+			"displayId":          commit.ID[:min(len(commit.ID), 11)],
+			"message":            "Commit " + commit.ID,
+			"author":             userJSON(commit.Author),
+			"authorTimestamp":    millis(commit.Authored),
+			"committer":          userJSON(commit.Author),
+			"committerTimestamp": millis(commit.Authored),
+		})
+	}
+	return values
+}
+
+func (server *Server) listCommits(w http.ResponseWriter, r *http.Request) {
+	_, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	// The default branch head is the newest commit, the ones reachable from until but not from since are listed
+	until := r.URL.Query().Get("until")
+	if until == "" {
+		if len(repo.Commits) == 0 {
+			writePage(w, r, commitsJSON(nil))
+			return
+		}
+		until = repo.Commits[len(repo.Commits)-1].ID
+	}
+	reachable := repo.reachable(until)
+	if len(reachable) == 0 {
+		notFound(w, fmt.Sprintf("Commit %s does not exist", until))
+		return
+	}
+	excluded := repo.reachable(r.URL.Query().Get("since"))
+	var commits []Commit
+	for _, commit := range repo.Commits {
+		if reachable[commit.ID] && !excluded[commit.ID] {
+			commits = append(commits, commit)
+		}
+	}
+	writePage(w, r, commitsJSON(commits))
+}
+
+// reachable returns the commits reachable from the given one, itself included
+func (repo *Repo) reachable(id string) map[string]bool {
+	indexes := map[string]int{}
+	for i, commit := range repo.Commits {
+		indexes[commit.ID] = i
+	}
+	reachable := map[string]bool{}
+	pending := []string{id}
+	for len(pending) > 0 {
+		id, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		index, ok := indexes[id]
+		if !ok || reachable[id] {
+			continue
+		}
+		reachable[id] = true
+		commit := repo.Commits[index]
+		if len(commit.Parents) > 0 {
+			pending = append(pending, commit.Parents...)
+		} else if index > 0 {
+			pending = append(pending, repo.Commits[index-1].ID)
+		}
+	}
+	return reachable
+}
+
+func (server *Server) getDefaultBranch(w http.ResponseWriter, r *http.Request) {
+	_, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":        "refs/heads/" + repo.DefaultBranch,
+		"displayId": repo.DefaultBranch,
+		"type":      "BRANCH",
+		"isDefault": true,
+	})
+}
+
+func (server *Server) listRefChanges(w http.ResponseWriter, r *http.Request) {
+	_, repo := server.findRepo(r)
+	if repo == nil {
+		notFound(w, fmt.Sprintf("Repository %s/%s does not exist", r.PathValue("project"), r.PathValue("repo")))
+		return
+	}
+	server.mutex.Lock()
+	var values []map[string]any
+	// Newest activities first
+	for i := len(repo.RefChanges) - 1; i >= 0; i-- {
+		refChange := repo.RefChanges[i]
+		refID := "refs/heads/" + refChange.Ref
+		if refChange.RefType == "TAG" {
+			refID = "refs/tags/" + refChange.Ref
+		}
+		values = append(values, map[string]any{
+			"id":          i + 1,
+			"createdDate": millis(refChange.Created),
+			"user":        userJSON(refChange.User),
+			"trigger":     "push",
+			"refChange": map[string]any{
+				"ref": map[string]any{
+					"id":        refID,
+					"displayId": refChange.Ref,
+					"type":      refChange.RefType,
+				},
+				"refId":  refID,
+				"toHash": refChange.Commit,
+				"type":   refChange.Type,
+			},
+		})
+	}
+	server.mutex.Unlock()
+	writePage(w, r, values)
+}
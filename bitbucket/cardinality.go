@@ -0,0 +1,80 @@
+package bitbucket
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+const OTHER_PERSON = "other"
+
+func (runner *Runner) cardinalityLimits(metric string) (int, int) {
+	cardinality := runner.config.Bitbucket.Metrics.Cardinality
+	maxSeries := cardinality.MaxSeries
+	if limit, ok := cardinality.Limits[metric]; ok {
+		maxSeries = limit
+	}
+	return cardinality.TopPerRepo, maxSeries
+}
+
+// sortedByValue sorts keys by descending value, ties broken by labels so the same series are kept on every collection
+func sortedByValue[K comparable](values map[K]int) []K {
+	return slices.SortedFunc(maps.Keys(values), func(a, b K) int {
+		return cmp.Or(cmp.Compare(values[b], values[a]), cmp.Compare(fmt.Sprint(a), fmt.Sprint(b)))
+	})
+}
+
+// foldPersons keeps the series with the highest values, up to topPerGroup per group and maxSeries overall
+// (0 means no limit), the rest are added to the other series of their group, which other returns for any key.
+// Other series count towards maxSeries too, so when there are more groups than maxSeries only the other series
+// of the groups with the highest values are kept
+func foldPersons[K comparable](values map[K]int, topPerGroup int, maxSeries int, other func(key K) K) (map[K]int, int) {
+	keys := sortedByValue(values)
+	keptLimit := maxSeries
+	dropped := map[K]bool{}
+	// Below the limit folding can only lower the series count, otherwise a slot is reserved for every other series
+	if maxSeries > 0 && len(keys) > maxSeries {
+		totals := map[K]int{}
+		for key, value := range values {
+			totals[other(key)] += value
+		}
+		groups := sortedByValue(totals)
+		for _, group := range groups[min(maxSeries, len(groups)):] {
+			dropped[group] = true
+		}
+		keptLimit = maxSeries - min(maxSeries, len(groups))
+	}
+	folded := map[K]int{}
+	foldedSeries := 0
+	keptSeries := 0
+	keptByGroup := map[K]int{}
+	for _, key := range keys {
+		group := other(key)
+		if dropped[group] {
+			foldedSeries += 1
+			continue
+		}
+		if key != group {
+			if (topPerGroup > 0 && keptByGroup[group] >= topPerGroup) || (maxSeries > 0 && keptSeries >= keptLimit) {
+				folded[group] += values[key]
+				foldedSeries += 1
+				continue
+			}
+			keptByGroup[group] += 1
+			keptSeries += 1
+		}
+		folded[key] += values[key]
+	}
+	return folded, foldedSeries
+}
+
+func otherPerson(key ProjectRepoPersonKey) ProjectRepoPersonKey {
+	key.person = OTHER_PERSON
+	return key
+}
+
+func otherPersonWindow(key ProjectRepoPersonWindowKey) ProjectRepoPersonWindowKey {
+	key.person = OTHER_PERSON
+	return key
+}
@@ -0,0 +1,469 @@
+package bitbucket
+
+import (
+	"bitbucket-metrics/metrics"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type collection struct {
+	errors               []error
+	projectsCount        int
+	reposCount           int
+	projects             []Project
+	repos                []ProjectRepo
+	prs                  map[ProjectRepoPRKey]PR
+	references           []ProjectRepoReference
+	openPRs              map[ProjectRepoKey]int
+	prsAwaitingReview    map[ProjectRepoKey]int
+	prsByAuthor          map[ProjectRepoPersonKey]int
+	prsByReviewer        map[ProjectRepoPersonKey]int
+	reviewPairs          map[ProjectPairKey]int
+	reviewQueue          map[ProjectRepoPersonKey]int
+	branchesByAuthor     map[ProjectRepoPersonKey]int
+	tagsByAuthor         map[ProjectRepoPersonKey]int
+	commitsByAuthor      map[ProjectRepoPersonWindowKey]int
+	commits              map[ProjectRepoKey][]Commit
+	commitsSince         time.Time
+	releases             map[ProjectRepoKey][]Reference
+	ownershipCommits     map[ProjectRepoPersonKey]int
+	prThroughput         map[ProjectRepoEventWindowKey]int
+	prThroughputByAuthor map[ProjectRepoPersonWindowKey]int
+	prLeadTimes          map[ProjectRepoKey][]float64
+	prReleaseLeadTimes   map[ProjectRepoKey][]float64
+	deployments          map[ProjectRepoWindowKey]int
+	prSizeLines          map[ProjectRepoKey][]float64
+	prsBySize            map[ProjectRepoSizeKey]int
+	linesAddedByAuthor   map[ProjectRepoPersonKey]int
+	linesRemovedByAuthor map[ProjectRepoPersonKey]int
+	filesChangedByAuthor map[ProjectRepoPersonKey]int
+	prComments           map[ProjectRepoKey][]float64
+	prOpenTasks          map[ProjectRepoKey][]float64
+	prResolvedTasks      map[ProjectRepoKey][]float64
+	prParticipants       map[ProjectRepoKey][]float64
+	commentsByAuthor     map[ProjectRepoPersonKey]int
+	prBuilds             map[ProjectRepoBuildKey]int
+	defaultBranchBuilds  map[ProjectRepoBuildKey]int
+	teams                map[string][]string
+	identities           *identities
+}
+
+func newCollection() *collection {
+	return &collection{
+		prs:                  map[ProjectRepoPRKey]PR{},
+		openPRs:              map[ProjectRepoKey]int{},
+		prsAwaitingReview:    map[ProjectRepoKey]int{},
+		prsByAuthor:          map[ProjectRepoPersonKey]int{},
+		prsByReviewer:        map[ProjectRepoPersonKey]int{},
+		reviewPairs:          map[ProjectPairKey]int{},
+		reviewQueue:          map[ProjectRepoPersonKey]int{},
+		branchesByAuthor:     map[ProjectRepoPersonKey]int{},
+		tagsByAuthor:         map[ProjectRepoPersonKey]int{},
+		commitsByAuthor:      map[ProjectRepoPersonWindowKey]int{},
+		commits:              map[ProjectRepoKey][]Commit{},
+		releases:             map[ProjectRepoKey][]Reference{},
+		ownershipCommits:     map[ProjectRepoPersonKey]int{},
+		prThroughput:         map[ProjectRepoEventWindowKey]int{},
+		prThroughputByAuthor: map[ProjectRepoPersonWindowKey]int{},
+		prLeadTimes:          map[ProjectRepoKey][]float64{},
+		prReleaseLeadTimes:   map[ProjectRepoKey][]float64{},
+		deployments:          map[ProjectRepoWindowKey]int{},
+		prSizeLines:          map[ProjectRepoKey][]float64{},
+		prsBySize:            map[ProjectRepoSizeKey]int{},
+		linesAddedByAuthor:   map[ProjectRepoPersonKey]int{},
+		linesRemovedByAuthor: map[ProjectRepoPersonKey]int{},
+		filesChangedByAuthor: map[ProjectRepoPersonKey]int{},
+		prComments:           map[ProjectRepoKey][]float64{},
+		prOpenTasks:          map[ProjectRepoKey][]float64{},
+		prResolvedTasks:      map[ProjectRepoKey][]float64{},
+		prParticipants:       map[ProjectRepoKey][]float64{},
+		commentsByAuthor:     map[ProjectRepoPersonKey]int{},
+		prBuilds:             map[ProjectRepoBuildKey]int{},
+		defaultBranchBuilds:  map[ProjectRepoBuildKey]int{},
+		teams:                map[string][]string{},
+		identities:           newIdentities(),
+	}
+}
+
+type ProjectRepoPRKey struct {
+	project string
+	repo    string
+	id      int
+}
+
+func (collection *collection) addPR(project string, repo string, pr PR) {
+	prKey := ProjectRepoPRKey{
+		project: project,
+		repo:    repo,
+		id:      pr.ID,
+	}
+	// Adding an already known PR replaces it, so PR updates are applied as many times as needed
+	collection.removePR(prKey)
+	collection.prs[prKey] = pr
+	collection.countPR(project, repo, pr, 1)
+}
+
+func (collection *collection) removePR(prKey ProjectRepoPRKey) {
+	if pr, ok := collection.prs[prKey]; ok {
+		collection.countPR(prKey.project, prKey.repo, pr, -1)
+		delete(collection.prs, prKey)
+	}
+}
+
+func (collection *collection) countPR(project string, repo string, pr PR, delta int) {
+	authorKey := ProjectRepoPersonKey{
+		project: project,
+		repo:    repo,
+		person:  pr.Author,
+	}
+	addCount(collection.prsByAuthor, authorKey, delta)
+	for _, reviewer := range pr.Reviewers {
+		reviewerKey := ProjectRepoPersonKey{
+			project: project,
+			repo:    repo,
+			person:  reviewer,
+		}
+		addCount(collection.prsByReviewer, reviewerKey, delta)
+		pairKey := ProjectPairKey{
+			project:  project,
+			author:   pr.Author,
+			reviewer: reviewer,
+		}
+		addCount(collection.reviewPairs, pairKey, delta)
+		if pr.State == "OPEN" && !slices.Contains(pr.Approvers, reviewer) {
+			addCount(collection.reviewQueue, reviewerKey, delta)
+		}
+	}
+	if pr.State == "OPEN" {
+		repoKey := ProjectRepoKey{
+			project: project,
+			repo:    repo,
+		}
+		collection.openPRs[repoKey] += delta
+		if len(pr.Approvers) == 0 {
+			collection.prsAwaitingReview[repoKey] += delta
+		}
+	}
+}
+
+// addCount drops person counts back to zero, so persons without PRs anymore aren't exported
+func addCount[K comparable](counts map[K]int, key K, delta int) {
+	counts[key] += delta
+	if counts[key] == 0 {
+		delete(counts, key)
+	}
+}
+
+type ProjectRepo struct {
+	Project string
+	Repo    Repo
+}
+
+type ProjectRepoReference struct {
+	Project   string
+	Repo      string
+	Reference Reference
+}
+
+func (collection *collection) addReferences(project string, repo string, references []Reference) {
+	for _, reference := range references {
+		authorKey := ProjectRepoPersonKey{
+			project: project,
+			repo:    repo,
+			person:  reference.Author,
+		}
+		switch reference.Type {
+		case "BRANCH":
+			collection.branchesByAuthor[authorKey] += 1
+		case "TAG":
+			collection.tagsByAuthor[authorKey] += 1
+		default:
+			continue
+		}
+		collection.references = append(collection.references, ProjectRepoReference{
+			Project:   project,
+			Repo:      repo,
+			Reference: reference,
+		})
+	}
+}
+
+func (collection *collection) hasReference(project string, repo string, reference Reference) bool {
+	return slices.ContainsFunc(collection.references, func(known ProjectRepoReference) bool {
+		return known.Project == project && known.Repo == repo && known.Reference.Name == reference.Name &&
+			known.Reference.Type == reference.Type && known.Reference.ChangeType == reference.ChangeType &&
+			known.Reference.Commit == reference.Commit
+	})
+}
+
+type ProjectRepoTeamKey struct {
+	project string
+	repo    string
+	team    string
+}
+
+type teamCounts struct {
+	prs           map[ProjectRepoTeamKey]int
+	prsByReviewer map[ProjectRepoTeamKey]int
+	branches      map[ProjectRepoTeamKey]int
+	tags          map[ProjectRepoTeamKey]int
+}
+
+func (collection *collection) teamsOf(persons ...string) []string {
+	var teams []string
+	for _, person := range persons {
+		person, ok := collection.identities.resolve(person)
+		if !ok {
+			continue
+		}
+		for _, team := range collection.teams[person] {
+			if !slices.Contains(teams, team) {
+				teams = append(teams, team)
+			}
+		}
+	}
+	return teams
+}
+
+func (collection *collection) countTeams() teamCounts {
+	counts := teamCounts{
+		prs:           map[ProjectRepoTeamKey]int{},
+		prsByReviewer: map[ProjectRepoTeamKey]int{},
+		branches:      map[ProjectRepoTeamKey]int{},
+		tags:          map[ProjectRepoTeamKey]int{},
+	}
+	if len(collection.teams) == 0 {
+		return counts
+	}
+	// A PR is counted once per team, even when several team members review it
+	for prKey, pr := range collection.prs {
+		for _, team := range collection.teamsOf(pr.Author) {
+			teamKey := ProjectRepoTeamKey{
+				project: prKey.project,
+				repo:    prKey.repo,
+				team:    team,
+			}
+			counts.prs[teamKey] += 1
+		}
+		for _, team := range collection.teamsOf(pr.Reviewers...) {
+			teamKey := ProjectRepoTeamKey{
+				project: prKey.project,
+				repo:    prKey.repo,
+				team:    team,
+			}
+			counts.prsByReviewer[teamKey] += 1
+		}
+	}
+	for _, reference := range collection.references {
+		for _, team := range collection.teamsOf(reference.Reference.Author) {
+			teamKey := ProjectRepoTeamKey{
+				project: reference.Project,
+				repo:    reference.Repo,
+				team:    team,
+			}
+			switch reference.Reference.Type {
+			case "BRANCH":
+				counts.branches[teamKey] += 1
+			case "TAG":
+				counts.tags[teamKey] += 1
+			}
+		}
+	}
+	return counts
+}
+
+func setRepoGauges(gauge *prometheus.GaugeVec, values map[ProjectRepoKey]int) {
+	for key, value := range values {
+		gauge.WithLabelValues(
+			key.project,
+			key.repo,
+		).Set(float64(value))
+	}
+}
+
+func setPersonGauges(gauge *prometheus.GaugeVec, values map[ProjectRepoPersonKey]int, withPersonLabels func(person string, labelValues ...string) []string) {
+	for key, value := range values {
+		gauge.WithLabelValues(withPersonLabels(
+			key.person,
+			key.project,
+			key.repo,
+			key.person,
+		)...).Set(float64(value))
+	}
+}
+
+func setTeamGauges(gauge *prometheus.GaugeVec, values map[ProjectRepoTeamKey]int) {
+	gauge.Reset()
+	for key, value := range values {
+		gauge.WithLabelValues(
+			key.project,
+			key.repo,
+			key.team,
+		).Set(float64(value))
+	}
+}
+
+func setRepoHistograms(histogram *metrics.SnapshotHistogramVec, values map[ProjectRepoKey][]float64) {
+	histogram.Reset()
+	for key, value := range values {
+		histogram.Set([]string{key.project, key.repo}, value)
+	}
+}
+
+func setBuildGauges(gauge *prometheus.GaugeVec, values map[ProjectRepoBuildKey]int) {
+	gauge.Reset()
+	for key, value := range values {
+		gauge.WithLabelValues(
+			key.project,
+			key.repo,
+			key.key,
+			key.state,
+		).Set(float64(value))
+	}
+}
+
+// publish sets the metrics of a collection, vectors whose series come & go are reset first so former ones are dropped
+func (runner *Runner) publish(collection *collection) {
+	runner.metrics.ProjectsGauge.Set(float64(collection.projectsCount))
+	runner.metrics.RepositoriesGauge.Set(float64(collection.reposCount))
+	// Person labels are normalized to canonical identities, merging aliases & dropping excluded persons
+	identities := collection.identities
+	foldedSeries := map[string]int{}
+	infos := collection.personInfos()
+	withPersonLabels := func(person string, labelValues ...string) []string {
+		for _, label := range runner.metrics.PersonLabels {
+			switch label {
+			case "display_name":
+				labelValues = append(labelValues, infos[person].displayName)
+			case "team":
+				labelValues = append(labelValues, infos[person].team)
+			}
+		}
+		return labelValues
+	}
+	setNormalizedPersonGauges := func(metric string, gauge *prometheus.GaugeVec, values map[ProjectRepoPersonKey]int) {
+		normalized := identities.normalize(values)
+		topPerRepo, maxSeries := runner.cardinalityLimits(metric)
+		if topPerRepo > 0 || maxSeries > 0 {
+			normalized, foldedSeries[metric] = foldPersons(normalized, topPerRepo, maxSeries, otherPerson)
+		}
+		gauge.Reset()
+		setPersonGauges(gauge, normalized, withPersonLabels)
+	}
+	setNormalizedPersonGauges("prs_by_author", runner.metrics.PRsByAuthorGauge, collection.prsByAuthor)
+	setNormalizedPersonGauges("prs_by_reviewer", runner.metrics.PRsByReviewerGauge, collection.prsByReviewer)
+	setNormalizedPersonGauges("review_queue", runner.metrics.ReviewQueueGauge, collection.reviewQueue)
+	runner.metrics.ReviewPairsGauge.Reset()
+	reviewPairs := identities.normalizePairs(collection.reviewPairs)
+	if topPerRepo, maxSeries := runner.cardinalityLimits("review_pairs"); topPerRepo > 0 || maxSeries > 0 {
+		reviewPairs, foldedSeries["review_pairs"] = foldPersons(reviewPairs, topPerRepo, maxSeries, otherPair)
+	}
+	for key, value := range reviewPairs {
+		runner.metrics.ReviewPairsGauge.WithLabelValues(
+			key.project,
+			key.author,
+			key.reviewer,
+		).Set(float64(value))
+	}
+	runner.metrics.ReviewGiniGauge.Reset()
+	for key, value := range collection.reviewGini() {
+		runner.metrics.ReviewGiniGauge.WithLabelValues(
+			key.project,
+			key.repo,
+		).Set(value)
+	}
+	setRepoGauges(runner.metrics.OpenPRsGauge, collection.openPRs)
+	setRepoGauges(runner.metrics.PRsAwaitingReviewGauge, collection.prsAwaitingReview)
+	setNormalizedPersonGauges("branches_by_author", runner.metrics.BranchesByAuthorGauge, collection.branchesByAuthor)
+	setNormalizedPersonGauges("tags_by_author", runner.metrics.TagsByAuthorGauge, collection.tagsByAuthor)
+	teamCounts := collection.countTeams()
+	setTeamGauges(runner.metrics.PRsByTeamGauge, teamCounts.prs)
+	setTeamGauges(runner.metrics.PRsByReviewerTeamGauge, teamCounts.prsByReviewer)
+	setTeamGauges(runner.metrics.BranchesByTeamGauge, teamCounts.branches)
+	setTeamGauges(runner.metrics.TagsByTeamGauge, teamCounts.tags)
+	runner.metrics.CommitsByAuthorGauge.Reset()
+	commitsByAuthor := identities.normalizeWindows(collection.commitsByAuthor)
+	if topPerRepo, maxSeries := runner.cardinalityLimits("commits_by_author"); topPerRepo > 0 || maxSeries > 0 {
+		commitsByAuthor, foldedSeries["commits_by_author"] = foldPersons(commitsByAuthor, topPerRepo, maxSeries, otherPersonWindow)
+	}
+	for key, value := range commitsByAuthor {
+		runner.metrics.CommitsByAuthorGauge.WithLabelValues(withPersonLabels(
+			key.person,
+			key.project,
+			key.repo,
+			key.person,
+			key.window,
+		)...).Set(float64(value))
+	}
+	runner.metrics.BusFactorGauge.Reset()
+	runner.metrics.TopContributorShareGauge.Reset()
+	for key, value := range collection.ownership(runner.config.Bitbucket.Collectors.Commits.Ownership.Coverage) {
+		runner.metrics.BusFactorGauge.WithLabelValues(
+			key.project,
+			key.repo,
+		).Set(float64(value.busFactor))
+		runner.metrics.TopContributorShareGauge.WithLabelValues(
+			key.project,
+			key.repo,
+		).Set(value.topContributorShare)
+	}
+	runner.metrics.PRThroughputGauge.Reset()
+	for key, value := range collection.prThroughput {
+		runner.metrics.PRThroughputGauge.WithLabelValues(
+			key.project,
+			key.repo,
+			key.event,
+			key.window,
+		).Set(float64(value))
+	}
+	runner.metrics.PRThroughputByAuthorGauge.Reset()
+	prThroughputByAuthor := identities.normalizeWindows(collection.prThroughputByAuthor)
+	if topPerRepo, maxSeries := runner.cardinalityLimits("pr_throughput_by_author"); topPerRepo > 0 || maxSeries > 0 {
+		prThroughputByAuthor, foldedSeries["pr_throughput_by_author"] = foldPersons(prThroughputByAuthor, topPerRepo, maxSeries, otherPersonWindow)
+	}
+	for key, value := range prThroughputByAuthor {
+		runner.metrics.PRThroughputByAuthorGauge.WithLabelValues(withPersonLabels(
+			key.person,
+			key.project,
+			key.repo,
+			key.person,
+			key.event,
+			key.window,
+		)...).Set(float64(value))
+	}
+	setRepoHistograms(runner.metrics.PRSizeLinesHistogram, collection.prSizeLines)
+	runner.metrics.PRsBySizeGauge.Reset()
+	for key, value := range collection.prsBySize {
+		runner.metrics.PRsBySizeGauge.WithLabelValues(
+			key.project,
+			key.repo,
+			key.size,
+		).Set(float64(value))
+	}
+	setNormalizedPersonGauges("pr_lines_added_by_author", runner.metrics.PRLinesAddedByAuthorGauge, collection.linesAddedByAuthor)
+	setNormalizedPersonGauges("pr_lines_removed_by_author", runner.metrics.PRLinesRemovedByAuthorGauge, collection.linesRemovedByAuthor)
+	setNormalizedPersonGauges("pr_files_changed_by_author", runner.metrics.PRFilesChangedByAuthorGauge, collection.filesChangedByAuthor)
+	setRepoHistograms(runner.metrics.PRCommentsHistogram, collection.prComments)
+	setRepoHistograms(runner.metrics.PROpenTasksHistogram, collection.prOpenTasks)
+	setRepoHistograms(runner.metrics.PRResolvedTasksHistogram, collection.prResolvedTasks)
+	setRepoHistograms(runner.metrics.PRParticipantsHistogram, collection.prParticipants)
+	setNormalizedPersonGauges("pr_comments_by_author", runner.metrics.PRCommentsByAuthorGauge, collection.commentsByAuthor)
+	setBuildGauges(runner.metrics.PRBuildsGauge, collection.prBuilds)
+	setBuildGauges(runner.metrics.DefaultBranchBuildsGauge, collection.defaultBranchBuilds)
+	setRepoHistograms(runner.metrics.PRLeadTimeHistogram, collection.prLeadTimes)
+	setRepoHistograms(runner.metrics.PRReleaseLeadTimeHistogram, collection.prReleaseLeadTimes)
+	runner.metrics.DeploymentsGauge.Reset()
+	for key, value := range collection.deployments {
+		runner.metrics.DeploymentsGauge.WithLabelValues(
+			key.project,
+			key.repo,
+			key.window,
+		).Set(float64(value))
+	}
+	runner.metrics.FoldedSeriesGauge.Reset()
+	for metric, value := range foldedSeries {
+		runner.metrics.FoldedSeriesGauge.WithLabelValues(metric).Set(float64(value))
+	}
+}
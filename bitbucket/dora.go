@@ -0,0 +1,169 @@
+package bitbucket
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ProjectRepoWindowKey struct {
+	project string
+	repo    string
+	window  string
+}
+
+func (runner *Runner) isReleaseTag(tag Reference) bool {
+	if tag.Type != "TAG" || (tag.ChangeType != "" && tag.ChangeType != "ADD") || tag.Created.IsZero() {
+		return false
+	}
+	for _, pattern := range runner.config.Bitbucket.Collectors.DORA.ReleaseTags {
+		if matched, _ := path.Match(pattern, tag.Name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// countDeployments counts the releases within each window until now
+func (runner *Runner) countDeployments(repoKey ProjectRepoKey, releases []Reference, collection *collection, now time.Time) {
+	for _, window := range runner.config.Bitbucket.Collectors.DORA.Windows {
+		duration, err := ParseWindow(window)
+		if err != nil {
+			continue
+		}
+		windowStart := now.Add(-duration)
+		windowKey := ProjectRepoWindowKey{
+			project: repoKey.project,
+			repo:    repoKey.repo,
+			window:  window,
+		}
+		collection.deployments[windowKey] += 0
+		for _, release := range releases {
+			if !release.Created.Before(windowStart) && !release.Created.After(now) {
+				collection.deployments[windowKey] += 1
+			}
+		}
+	}
+}
+
+type releaseCommit struct {
+	release string
+	commit  string
+}
+
+// collectDORA counts release tags as deployments and measures lead times of PRs merged into the default branch,
+// a PR is taken as released by the first release tag created after its merge which contains its merge commit.
+// PRs & tags are requested here when their collectors are disabled
+func (runner *Runner) collectDORA(project Project, repo Repo, prs []PR, tags []Reference, collection *collection) {
+	log.WithFields(log.Fields{
+		"project": project.Key,
+		"repo":    repo.Name,
+	}).Info("Collecting DORA metrics...")
+	collectors := runner.config.Bitbucket.Collectors
+	doraConfig := collectors.DORA
+	now := time.Now()
+	repoKey := ProjectRepoKey{
+		project: project.Key,
+		repo:    repo.Name,
+	}
+	if !collectors.References.Enabled {
+		var err error
+		_, tags, err = References(runner.request, project.Key, repo.Slug)
+		if err != nil {
+			collection.errors = append(collection.errors, err)
+			return
+		}
+	}
+	if !collectors.PRs.Enabled {
+		var err error
+		prs, err = PRs(runner.request, project.Key, repo.Slug)
+		if err != nil {
+			collection.errors = append(collection.errors, err)
+			return
+		}
+	}
+
+	releases := slices.DeleteFunc(slices.Clone(tags), func(tag Reference) bool {
+		return !runner.isReleaseTag(tag)
+	})
+	slices.SortFunc(releases, func(a, b Reference) int {
+		return a.Created.Compare(b.Created)
+	})
+	collection.releases[repoKey] = releases
+	runner.countDeployments(repoKey, releases, collection, now)
+
+	leadTimeWindow, err := ParseWindow(doraConfig.LeadTimeWindow)
+	if err != nil {
+		return
+	}
+	mergedSince := now.Add(-leadTimeWindow)
+	merged := slices.DeleteFunc(slices.Clone(prs), func(pr PR) bool {
+		return pr.State != "MERGED" || pr.Closed.Before(mergedSince)
+	})
+	if len(merged) == 0 {
+		delete(runner.releases, repoKey)
+		return
+	}
+	defaultBranch, err := DefaultBranch(runner.request, project.Key, repo.Slug)
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+		return
+	}
+	merged = slices.DeleteFunc(merged, func(pr PR) bool {
+		return pr.Target != defaultBranch
+	})
+	firstCommits := runner.prFirstCommits.refresh(repoKey, merged, collection, func(pr PR) (time.Time, error) {
+		return PRFirstCommit(runner.request, project.Key, repo.Slug, pr.ID)
+	})
+	// Whether a release contains a commit never changes, so just the checks of new releases or PRs are requested
+	cachedReleases := runner.releases[repoKey]
+	checkedReleases := map[releaseCommit]bool{}
+	contains := func(release Reference, commit string) (bool, error) {
+		key := releaseCommit{
+			release: release.Commit,
+			commit:  commit,
+		}
+		contained, ok := cachedReleases[key]
+		if !ok {
+			var err error
+			contained, err = ContainsCommit(runner.request, project.Key, repo.Slug, release.Commit, commit)
+			if err != nil {
+				return false, err
+			}
+		}
+		checkedReleases[key] = contained
+		return contained, nil
+	}
+	for _, pr := range merged {
+		if firstCommit, ok := firstCommits[pr.ID]; ok && !firstCommit.IsZero() && !firstCommit.After(pr.Closed) {
+			collection.prLeadTimes[repoKey] = append(collection.prLeadTimes[repoKey], pr.Closed.Sub(firstCommit).Seconds())
+		}
+		// Fast-forwarded PRs have no merge commit, but their head one is merged as is
+		commit := cmp.Or(pr.MergeCommit, pr.HeadCommit)
+		if commit == "" {
+			continue
+		}
+		// PRs not released yet have no release lead time
+		index, _ := slices.BinarySearchFunc(releases, pr.Closed, func(release Reference, merged time.Time) int {
+			return cmp.Compare(release.Created.UnixMilli(), merged.UnixMilli())
+		})
+		for _, release := range releases[index:] {
+			if release.Commit == "" {
+				continue
+			}
+			contained, err := contains(release, commit)
+			if err != nil {
+				collection.errors = append(collection.errors, err)
+				break
+			}
+			if contained {
+				collection.prReleaseLeadTimes[repoKey] = append(collection.prReleaseLeadTimes[repoKey], release.Created.Sub(pr.Closed).Seconds())
+				break
+			}
+		}
+	}
+	runner.releases[repoKey] = checkedReleases
+}
@@ -0,0 +1,232 @@
+package bitbucket
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var EXPORT_FORMATS = []string{"jsonl", "csv"}
+
+var EXPORT_CSV_HEADER = []string{"type", "project", "repo", "id", "name", "description", "state", "ref_type", "author", "reviewers", "updated"}
+
+type ExportRecord struct {
+	Type        string   `json:"type"`
+	Project     string   `json:"project"`
+	Repo        string   `json:"repo,omitempty"`
+	ID          int      `json:"id,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	State       string   `json:"state,omitempty"`
+	RefType     string   `json:"ref_type,omitempty"`
+	Author      string   `json:"author,omitempty"`
+	Reviewers   []string `json:"reviewers,omitempty"`
+	Updated     string   `json:"updated,omitempty"`
+}
+
+func (record ExportRecord) csv() []string {
+	id := ""
+	if record.ID != 0 {
+		id = strconv.Itoa(record.ID)
+	}
+	return []string{
+		record.Type,
+		record.Project,
+		record.Repo,
+		id,
+		record.Name,
+		record.Description,
+		record.State,
+		record.RefType,
+		record.Author,
+		strings.Join(record.Reviewers, ";"),
+		record.Updated,
+	}
+}
+
+func (collection *collection) exportRecords() []ExportRecord {
+	var records []ExportRecord
+
+	projects := slices.SortedFunc(slices.Values(collection.projects), func(a, b Project) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+	for _, project := range projects {
+		records = append(records, ExportRecord{
+			Type:        "project",
+			Project:     project.Key,
+			Name:        project.Name,
+			Description: project.Description,
+		})
+	}
+
+	repos := slices.SortedFunc(slices.Values(collection.repos), func(a, b ProjectRepo) int {
+		return cmp.Or(cmp.Compare(a.Project, b.Project), cmp.Compare(a.Repo.Name, b.Repo.Name))
+	})
+	for _, repo := range repos {
+		records = append(records, ExportRecord{
+			Type:    "repo",
+			Project: repo.Project,
+			Repo:    repo.Repo.Name,
+			Name:    repo.Repo.Name,
+		})
+	}
+
+	// Persons are labeled like on metrics, so exports give no pseudonymized or excluded person away
+	identities := collection.identities
+	label := func(person string) string {
+		label, _ := identities.label(person)
+		return label
+	}
+	labels := func(persons []string) []string {
+		var labels []string
+		for _, person := range persons {
+			if label := label(person); label != "" {
+				labels = append(labels, label)
+			}
+		}
+		return labels
+	}
+
+	prKeys := slices.SortedFunc(maps.Keys(collection.prs), func(a, b ProjectRepoPRKey) int {
+		return cmp.Or(cmp.Compare(a.project, b.project), cmp.Compare(a.repo, b.repo), cmp.Compare(a.id, b.id))
+	})
+	for _, prKey := range prKeys {
+		pr := collection.prs[prKey]
+		updated := ""
+		if !pr.Updated.IsZero() {
+			updated = pr.Updated.UTC().Format(time.RFC3339)
+		}
+		records = append(records, ExportRecord{
+			Type:      "pr",
+			Project:   prKey.project,
+			Repo:      prKey.repo,
+			ID:        pr.ID,
+			Name:      pr.Name,
+			State:     pr.State,
+			Author:    label(pr.Author),
+			Reviewers: labels(pr.Reviewers),
+			Updated:   updated,
+		})
+	}
+
+	for _, reference := range collection.references {
+		records = append(records, ExportRecord{
+			Type:    "reference",
+			Project: reference.Project,
+			Repo:    reference.Repo,
+			Name:    reference.Reference.Name,
+			RefType: reference.Reference.Type,
+			Author:  label(reference.Reference.Author),
+		})
+	}
+	return records
+}
+
+func writeExportRecords(writer io.Writer, format string, records []ExportRecord) error {
+	switch format {
+	case "jsonl":
+		encoder := json.NewEncoder(writer)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		csvWriter := csv.NewWriter(writer)
+		if err := csvWriter.Write(EXPORT_CSV_HEADER); err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := csvWriter.Write(record.csv()); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	default:
+		return fmt.Errorf("unknown export format '%s', valid ones are %v", format, EXPORT_FORMATS)
+	}
+}
+
+func (runner *Runner) exportRecords() ([]ExportRecord, error) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	if runner.collection == nil {
+		return nil, errors.New("no metrics collection done yet")
+	}
+	return runner.collection.exportRecords(), nil
+}
+
+func (runner *Runner) Export(writer io.Writer, format string) error {
+	if !slices.Contains(EXPORT_FORMATS, format) {
+		return fmt.Errorf("unknown export format '%s', valid ones are %v", format, EXPORT_FORMATS)
+	}
+	records, err := runner.exportRecords()
+	if err != nil {
+		return err
+	}
+	err = writeExportRecords(writer, format, records)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"format": format,
+			"error":  err,
+		}).Error("Cannot export records")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"format":  format,
+		"records": len(records),
+	}).Info("Records exported")
+	return nil
+}
+
+type ExportHandler struct {
+	runner *Runner
+}
+
+func NewExportHandler(runner *Runner) *ExportHandler {
+	return &ExportHandler{
+		runner: runner,
+	}
+}
+
+func (handler *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if !slices.Contains(EXPORT_FORMATS, format) {
+		http.Error(w, fmt.Sprintf("Unknown format '%s', valid ones are %v", format, EXPORT_FORMATS), http.StatusBadRequest)
+		return
+	}
+	records, err := handler.runner.exportRecords()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/jsonl")
+	}
+	err = writeExportRecords(w, format, records)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"format": format,
+			"error":  err,
+		}).Error("Cannot export records via HTTP")
+	}
+}
@@ -0,0 +1,84 @@
+package bitbucket
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newExportTestRunner() *Runner {
+	collection := newCollection()
+	collection.projects = []Project{{Key: "P2", Name: "Project 2"}, {Key: "P1", Name: "Project 1", Description: "First"}}
+	collection.repos = []ProjectRepo{{Project: "P1", Repo: Repo{Slug: "repo-1", Name: "repo-1"}}}
+	collection.addPR("P1", "repo-1", PR{
+		ID:        2,
+		Updated:   time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Name:      "Fix, with comma",
+		State:     "OPEN",
+		Author:    "alice",
+		Reviewers: []string{"bob", "carol"},
+	})
+	collection.addReferences("P1", "repo-1", []Reference{{Name: "main", Type: "BRANCH", Author: "alice"}})
+	return &Runner{
+		collection: collection,
+	}
+}
+
+func TestExportJSONLines(t *testing.T) {
+	var buffer bytes.Buffer
+	err := newExportTestRunner().Export(&buffer, "jsonl")
+	if err != nil {
+		t.Fatalf("Export failed with error: %v", err)
+	}
+	expected := `{"type":"project","project":"P1","name":"Project 1","description":"First"}
+{"type":"project","project":"P2","name":"Project 2"}
+{"type":"repo","project":"P1","repo":"repo-1","name":"repo-1"}
+{"type":"pr","project":"P1","repo":"repo-1","id":2,"name":"Fix, with comma","state":"OPEN","author":"alice","reviewers":["bob","carol"],"updated":"2025-01-02T03:04:05Z"}
+{"type":"reference","project":"P1","repo":"repo-1","name":"main","ref_type":"BRANCH","author":"alice"}
+`
+	if buffer.String() != expected {
+		t.Errorf("Unexpected JSON lines export:\n%v\nexpected:\n%v", buffer.String(), expected)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	var buffer bytes.Buffer
+	err := newExportTestRunner().Export(&buffer, "csv")
+	if err != nil {
+		t.Fatalf("Export failed with error: %v", err)
+	}
+	expected := `type,project,repo,id,name,description,state,ref_type,author,reviewers,updated
+project,P1,,,Project 1,First,,,,,
+project,P2,,,Project 2,,,,,,
+repo,P1,repo-1,,repo-1,,,,,,
+pr,P1,repo-1,2,"Fix, with comma",,OPEN,,alice,bob;carol,2025-01-02T03:04:05Z
+reference,P1,repo-1,,main,,,BRANCH,alice,,
+`
+	if buffer.String() != expected {
+		t.Errorf("Unexpected CSV export:\n%v\nexpected:\n%v", buffer.String(), expected)
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	handler := NewExportHandler(&Runner{})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status code %v before any collection, expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	handler = NewExportHandler(newExportTestRunner())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/export?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %v with an invalid format, expected %v", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/export?format=csv", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Errorf("Unexpected status code %v or content type '%v'", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,264 @@
+package bitbucket
+
+import (
+	"bitbucket-metrics/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var PERSON_LABELS = []string{"keep", "hash", "drop"}
+
+// PersonLabels returns the labels single person series have after the person one
+func PersonLabels(config *config.Config) []string {
+	var labels []string
+	// Display names would give pseudonymized persons away
+	identities := config.Bitbucket.Identities
+	if identities.DisplayName && identities.PersonLabels != "hash" {
+		labels = append(labels, "display_name")
+	}
+	if len(config.Bitbucket.Teams) > 0 {
+		labels = append(labels, "team")
+	}
+	return labels
+}
+
+type identities struct {
+	canonicals   map[string]string
+	displayNames map[string]string
+	excluded     map[string]bool
+	exclude      []string
+	personLabels string
+	salt         []byte
+}
+
+func newIdentities() *identities {
+	return &identities{
+		canonicals:   map[string]string{},
+		displayNames: map[string]string{},
+		excluded:     map[string]bool{},
+	}
+}
+
+func (identities *identities) addUser(user User, excludeServiceUsers bool) {
+	// PRs label persons by slug while references use the name, so any of them leads to the slug
+	for _, key := range []string{user.Slug, user.Name, user.Email} {
+		if key != "" {
+			identities.canonicals[strings.ToLower(key)] = user.Slug
+		}
+	}
+	if user.DisplayName != "" {
+		identities.displayNames[user.Slug] = user.DisplayName
+	}
+	if excludeServiceUsers && user.Type == "SERVICE" {
+		identities.excluded[user.Slug] = true
+	}
+}
+
+func (identities *identities) addAliases(aliases map[string][]string) {
+	for canonical, names := range aliases {
+		for _, name := range names {
+			identities.canonicals[strings.ToLower(name)] = canonical
+		}
+	}
+}
+
+func (identities *identities) canonical(person string) string {
+	if canonical, ok := identities.canonicals[strings.ToLower(person)]; ok {
+		return canonical
+	}
+	return person
+}
+
+func (identities *identities) isExcluded(person string) bool {
+	if identities.excluded[person] {
+		return true
+	}
+	for _, pattern := range identities.exclude {
+		if matched, _ := path.Match(pattern, person); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the canonical identity of a person and whether it must be labeled at all
+func (identities *identities) resolve(person string) (string, bool) {
+	canonical := identities.canonical(person)
+	return canonical, !identities.isExcluded(canonical) && !identities.isExcluded(person)
+}
+
+func (identities *identities) pseudonym(person string) string {
+	mac := hmac.New(sha256.New, identities.salt)
+	mac.Write([]byte(person))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// label returns how a person is labeled on metrics & exports and whether it's labeled at all
+func (identities *identities) label(person string) (string, bool) {
+	canonical, ok := identities.resolve(person)
+	if !ok {
+		return "", false
+	}
+	switch identities.personLabels {
+	case "hash":
+		return identities.pseudonym(canonical), true
+	case "drop":
+		return "", false
+	default:
+		return canonical, true
+	}
+}
+
+func (identities *identities) displayName(person string) string {
+	if displayName, ok := identities.displayNames[person]; ok {
+		return displayName
+	}
+	return person
+}
+
+func (identities *identities) normalize(values map[ProjectRepoPersonKey]int) map[ProjectRepoPersonKey]int {
+	normalized := map[ProjectRepoPersonKey]int{}
+	for key, value := range values {
+		person, ok := identities.label(key.person)
+		if !ok {
+			continue
+		}
+		key.person = person
+		normalized[key] += value
+	}
+	return normalized
+}
+
+func (identities *identities) normalizeWindows(values map[ProjectRepoPersonWindowKey]int) map[ProjectRepoPersonWindowKey]int {
+	normalized := map[ProjectRepoPersonWindowKey]int{}
+	for key, value := range values {
+		person, ok := identities.label(key.person)
+		if !ok {
+			continue
+		}
+		key.person = person
+		normalized[key] += value
+	}
+	return normalized
+}
+
+func (runner *Runner) collectIdentities(collection *collection) *identities {
+	identitiesConfig := runner.config.Bitbucket.Identities
+	identities := newIdentities()
+	identities.exclude = identitiesConfig.Exclude
+	identities.personLabels = identitiesConfig.PersonLabels
+	identities.salt = runner.pseudonymSalt
+	if identitiesConfig.Directory {
+		log.Info("Collecting users directory...")
+		users, err := Users(runner.request)
+		if err != nil {
+			collection.errors = append(collection.errors, err)
+		} else {
+			for _, user := range users {
+				identities.addUser(user, identitiesConfig.ExcludeServiceUsers)
+			}
+		}
+	}
+	// Aliases are applied last, so they win over the users directory
+	identities.addAliases(identitiesConfig.Aliases)
+	return identities
+}
+
+func (collection *collection) persons() map[string]bool {
+	persons := map[string]bool{}
+	add := func(person string) {
+		if canonical, ok := collection.identities.resolve(person); ok {
+			persons[canonical] = true
+		}
+	}
+	personValues := []map[ProjectRepoPersonKey]int{
+		collection.prsByAuthor,
+		collection.prsByReviewer,
+		collection.reviewQueue,
+		collection.branchesByAuthor,
+		collection.tagsByAuthor,
+		collection.linesAddedByAuthor,
+		collection.linesRemovedByAuthor,
+		collection.filesChangedByAuthor,
+		collection.commentsByAuthor,
+	}
+	for _, values := range personValues {
+		for key := range values {
+			add(key.person)
+		}
+	}
+	for key := range collection.commitsByAuthor {
+		add(key.person)
+	}
+	for key := range collection.prThroughputByAuthor {
+		add(key.person)
+	}
+	for key := range collection.reviewPairs {
+		add(key.author)
+		add(key.reviewer)
+	}
+	for _, canonical := range collection.identities.canonicals {
+		add(canonical)
+	}
+	for person := range collection.teams {
+		add(person)
+	}
+	return persons
+}
+
+type personInfo struct {
+	displayName string
+	team        string
+}
+
+// personInfos returns what person series tell besides the person, by person label
+func (collection *collection) personInfos() map[string]personInfo {
+	infos := map[string]personInfo{}
+	for person := range collection.persons() {
+		label, ok := collection.identities.label(person)
+		if !ok {
+			continue
+		}
+		// Persons in several teams have them all, comma separated
+		teams := slices.Clone(collection.teams[person])
+		slices.Sort(teams)
+		infos[label] = personInfo{
+			displayName: collection.identities.displayName(person),
+			team:        strings.Join(teams, ","),
+		}
+	}
+	return infos
+}
+
+func (runner *Runner) Pseudonymize(salt string) {
+	runner.pseudonymSalt = []byte(salt)
+}
+
+// Reveal maps pseudonyms back to the persons known by the last collection, unknown ones are missing
+func (runner *Runner) Reveal(pseudonyms []string) (map[string]string, error) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	if runner.collection == nil {
+		return nil, errors.New("no metrics collection done yet")
+	}
+	wanted := map[string]bool{}
+	for _, pseudonym := range pseudonyms {
+		wanted[pseudonym] = true
+	}
+	revealed := map[string]string{}
+	identities := runner.collection.identities
+	for person := range runner.collection.persons() {
+		pseudonym := identities.pseudonym(person)
+		if wanted[pseudonym] {
+			revealed[pseudonym] = person
+		}
+	}
+	return revealed, nil
+}
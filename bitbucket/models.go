@@ -0,0 +1,268 @@
+package bitbucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type Page[T any] struct {
+	Size          int  `json:"size"`
+	Limit         int  `json:"limit"`
+	Start         int  `json:"start"`
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart *int `json:"nextPageStart"`
+	Values        []T  `json:"values"`
+}
+
+type UserPayload struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Slug         string `json:"slug"`
+	DisplayName  string `json:"displayName"`
+	EmailAddress string `json:"emailAddress"`
+	Active       bool   `json:"active"`
+	Type         string `json:"type"`
+}
+
+type ProjectPayload struct {
+	ID          int    `json:"id"`
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Public      bool   `json:"public"`
+	Type        string `json:"type"`
+}
+
+func (project ProjectPayload) Validate() error {
+	if project.Key == "" {
+		return errors.New("project without key")
+	}
+	if project.Name == "" {
+		return fmt.Errorf("project '%s' without name", project.Key)
+	}
+	return nil
+}
+
+type RepoPayload struct {
+	ID      int            `json:"id"`
+	Slug    string         `json:"slug"`
+	Name    string         `json:"name"`
+	State   string         `json:"state"`
+	Public  bool           `json:"public"`
+	Project ProjectPayload `json:"project"`
+}
+
+func (repo RepoPayload) Validate() error {
+	if repo.Slug == "" {
+		return errors.New("repo without slug")
+	}
+	if repo.Name == "" {
+		return fmt.Errorf("repo '%s' without name", repo.Slug)
+	}
+	return nil
+}
+
+type RefPayload struct {
+	ID           string      `json:"id"`
+	DisplayID    string      `json:"displayId"`
+	Type         string      `json:"type"`
+	LatestCommit string      `json:"latestCommit"`
+	Repository   RepoPayload `json:"repository"`
+}
+
+type ParticipantPayload struct {
+	User     UserPayload `json:"user"`
+	Role     string      `json:"role"`
+	Approved bool        `json:"approved"`
+	Status   string      `json:"status"`
+}
+
+type PullRequestPayload struct {
+	ID           int                  `json:"id"`
+	Version      int                  `json:"version"`
+	Title        string               `json:"title"`
+	Description  string               `json:"description"`
+	State        string               `json:"state"`
+	Open         bool                 `json:"open"`
+	Closed       bool                 `json:"closed"`
+	CreatedDate  int64                `json:"createdDate"`
+	UpdatedDate  int64                `json:"updatedDate"`
+	ClosedDate   int64                `json:"closedDate"`
+	FromRef      RefPayload           `json:"fromRef"`
+	ToRef        RefPayload           `json:"toRef"`
+	Author       ParticipantPayload   `json:"author"`
+	Reviewers    []ParticipantPayload `json:"reviewers"`
+	Participants []ParticipantPayload `json:"participants"`
+	Properties   PRPropertiesPayload  `json:"properties"`
+}
+
+type PRPropertiesPayload struct {
+	MergeCommit MergeCommitPayload `json:"mergeCommit"`
+}
+
+type MergeCommitPayload struct {
+	ID        string `json:"id"`
+	DisplayID string `json:"displayId"`
+}
+
+func (pr PullRequestPayload) Validate() error {
+	if pr.Title == "" {
+		return fmt.Errorf("PR #%d without title", pr.ID)
+	}
+	if pr.State == "" {
+		return fmt.Errorf("PR #%d without state", pr.ID)
+	}
+	if pr.Author.User.Slug == "" {
+		return fmt.Errorf("PR #%d without author slug", pr.ID)
+	}
+	for _, reviewer := range pr.Reviewers {
+		if reviewer.User.Slug == "" {
+			return fmt.Errorf("PR #%d with a reviewer without slug", pr.ID)
+		}
+	}
+	return nil
+}
+
+type RefChangePayload struct {
+	Ref      RefPayload `json:"ref"`
+	RefID    string     `json:"refId"`
+	FromHash string     `json:"fromHash"`
+	ToHash   string     `json:"toHash"`
+	Type     string     `json:"type"`
+}
+
+type RefChangeActivityPayload struct {
+	ID          int              `json:"id"`
+	CreatedDate int64            `json:"createdDate"`
+	User        UserPayload      `json:"user"`
+	Trigger     string           `json:"trigger"`
+	RefChange   RefChangePayload `json:"refChange"`
+}
+
+func (activity RefChangeActivityPayload) Validate() error {
+	if activity.User.Name == "" {
+		return fmt.Errorf("ref change activity #%d without user name", activity.ID)
+	}
+	if activity.RefChange.Ref.DisplayID == "" {
+		return fmt.Errorf("ref change activity #%d without ref display ID", activity.ID)
+	}
+	if activity.RefChange.Ref.Type == "" {
+		return fmt.Errorf("ref change activity #%d without ref type", activity.ID)
+	}
+	return nil
+}
+
+type CommitPayload struct {
+	ID                 string      `json:"id"`
+	DisplayID          string      `json:"displayId"`
+	Message            string      `json:"message"`
+	Author             UserPayload `json:"author"`
+	AuthorTimestamp    int64       `json:"authorTimestamp"`
+	Committer          UserPayload `json:"committer"`
+	CommitterTimestamp int64       `json:"committerTimestamp"`
+}
+
+func (commit CommitPayload) Validate() error {
+	if commit.ID == "" {
+		return errors.New("commit without ID")
+	}
+	if commit.Author.Slug == "" && commit.Author.Name == "" {
+		return fmt.Errorf("commit '%s' without author", commit.ID)
+	}
+	return nil
+}
+
+type DiffSegmentPayload struct {
+	Type      string            `json:"type"`
+	Lines     []json.RawMessage `json:"lines"`
+	Truncated bool              `json:"truncated"`
+}
+
+type DiffHunkPayload struct {
+	Segments  []DiffSegmentPayload `json:"segments"`
+	Truncated bool                 `json:"truncated"`
+}
+
+type DiffPayload struct {
+	Hunks     []DiffHunkPayload `json:"hunks"`
+	Truncated bool              `json:"truncated"`
+}
+
+type DiffsPayload struct {
+	FromHash  string        `json:"fromHash"`
+	ToHash    string        `json:"toHash"`
+	Diffs     []DiffPayload `json:"diffs"`
+	Truncated bool          `json:"truncated"`
+}
+
+type CommentPayload struct {
+	ID          int              `json:"id"`
+	Version     int              `json:"version"`
+	Text        string           `json:"text"`
+	Author      UserPayload      `json:"author"`
+	CreatedDate int64            `json:"createdDate"`
+	UpdatedDate int64            `json:"updatedDate"`
+	Severity    string           `json:"severity"`
+	State       string           `json:"state"`
+	Comments    []CommentPayload `json:"comments"`
+}
+
+func (comment CommentPayload) Validate() error {
+	if comment.ID == 0 {
+		return errors.New("comment without ID")
+	}
+	if comment.Author.Slug == "" {
+		return fmt.Errorf("comment #%d without author slug", comment.ID)
+	}
+	return nil
+}
+
+type PullRequestActivityPayload struct {
+	ID            int             `json:"id"`
+	CreatedDate   int64           `json:"createdDate"`
+	User          UserPayload     `json:"user"`
+	Action        string          `json:"action"`
+	CommentAction string          `json:"commentAction"`
+	Comment       *CommentPayload `json:"comment"`
+}
+
+type TaskPayload struct {
+	ID          int         `json:"id"`
+	Text        string      `json:"text"`
+	State       string      `json:"state"`
+	Author      UserPayload `json:"author"`
+	CreatedDate int64       `json:"createdDate"`
+}
+
+func (task TaskPayload) Validate() error {
+	if task.State == "" {
+		return fmt.Errorf("task #%d without state", task.ID)
+	}
+	return nil
+}
+
+type BuildStatusPayload struct {
+	State       string `json:"state"`
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	DateAdded   int64  `json:"dateAdded"`
+	UpdatedDate int64  `json:"updatedDate"`
+}
+
+// Updated returns when the build status was last reported, by the repository or the legacy API
+func (build BuildStatusPayload) Updated() int64 {
+	return max(build.DateAdded, build.UpdatedDate)
+}
+
+func (build BuildStatusPayload) Validate() error {
+	if build.Key == "" {
+		return errors.New("build status without key")
+	}
+	if build.State == "" {
+		return fmt.Errorf("build status '%s' without state", build.Key)
+	}
+	return nil
+}
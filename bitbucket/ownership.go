@@ -0,0 +1,65 @@
+package bitbucket
+
+import (
+	"maps"
+	"slices"
+)
+
+type ownership struct {
+	busFactor           int
+	topContributorShare float64
+}
+
+// busFactor returns how few authors, most prolific first, make up the coverage share of all commits
+func busFactor(commits []int, coverage float64) int {
+	total := 0
+	for _, value := range commits {
+		total += value
+	}
+	if total == 0 {
+		return 0
+	}
+	sorted := slices.Sorted(slices.Values(commits))
+	slices.Reverse(sorted)
+	covered := 0
+	for i, value := range sorted {
+		covered += value
+		if float64(covered) >= coverage*float64(total) {
+			return i + 1
+		}
+	}
+	return len(sorted)
+}
+
+// ownership returns the bus factor & top contributor share of each repo with commits within the ownership window,
+// aliases counting as their canonical person & excluded persons (like bots) not counting at all
+func (collection *collection) ownership(coverage float64) map[ProjectRepoKey]ownership {
+	commits := map[ProjectRepoKey]map[string]int{}
+	for key, value := range collection.ownershipCommits {
+		person, ok := collection.identities.resolve(key.person)
+		if !ok {
+			continue
+		}
+		repoKey := ProjectRepoKey{
+			project: key.project,
+			repo:    key.repo,
+		}
+		if _, ok := commits[repoKey]; !ok {
+			commits[repoKey] = map[string]int{}
+		}
+		commits[repoKey][person] += value
+	}
+	ownerships := map[ProjectRepoKey]ownership{}
+	for repoKey, persons := range commits {
+		values := slices.Collect(maps.Values(persons))
+		total := 0
+		for _, value := range values {
+			total += value
+		}
+		ownerships[repoKey] = ownership{
+			busFactor:           busFactor(values, coverage),
+			topContributorShare: float64(slices.Max(values)) / float64(total),
+		}
+	}
+	return ownerships
+}
@@ -0,0 +1,158 @@
+package bitbucket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RecordedResponse struct {
+	Method string     `json:"method"`
+	Path   string     `json:"path"`
+	Query  url.Values `json:"query"`
+	Status int        `json:"status"`
+	Body   string     `json:"body"`
+}
+
+func recordingFilename(directory string, basePath string, request *http.Request) (string, string) {
+	// Paths are kept relative to the base URL, so recordings can be replayed against any base URL
+	path := strings.TrimPrefix(request.URL.Path, strings.TrimSuffix(basePath, "/"))
+	key := request.Method + " " + path + "?" + request.URL.Query().Encode()
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(directory, hex.EncodeToString(hash[:])[:16]+".json"), path
+}
+
+type RecordingTransport struct {
+	directory string
+	basePath  string
+	next      http.RoundTripper
+}
+
+func NewRecordingTransport(directory string, baseURL string, next http.RoundTripper) (*RecordingTransport, error) {
+	parsedBaseURL, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(directory, 0o755)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"directory": directory,
+			"error":     err,
+		}).Error("Cannot create recordings directory")
+		return nil, err
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RecordingTransport{
+		directory: directory,
+		basePath:  parsedBaseURL.Path,
+		next:      next,
+	}, nil
+}
+
+func (transport *RecordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := transport.next.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The body was consumed, so give the caller a fresh copy of it
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	filename, path := recordingFilename(transport.directory, transport.basePath, request)
+	recorded := RecordedResponse{
+		Method: request.Method,
+		Path:   path,
+		Query:  request.URL.Query(),
+		Status: response.StatusCode,
+		Body:   string(body),
+	}
+	content, err := json.MarshalIndent(recorded, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filename, content, 0o644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"filename": filename,
+			"error":    err,
+		}).Error("Cannot record response")
+	} else {
+		log.WithFields(log.Fields{
+			"filename": filename,
+			"path":     path,
+		}).Debug("Response recorded")
+	}
+	return response, nil
+}
+
+type ReplayTransport struct {
+	directory string
+	basePath  string
+}
+
+func NewReplayTransport(directory string, baseURL string) (*ReplayTransport, error) {
+	parsedBaseURL, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(directory)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("replay path '%s' is not a directory", directory)
+	}
+	return &ReplayTransport{
+		directory: directory,
+		basePath:  parsedBaseURL.Path,
+	}, nil
+}
+
+func (transport *ReplayTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	filename, path := recordingFilename(transport.directory, transport.basePath, request)
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"method":   request.Method,
+			"path":     path,
+			"query":    request.URL.RawQuery,
+			"filename": filename,
+		}).Error("No recorded response to replay")
+		return nil, fmt.Errorf("no recorded response for %s %s?%s", request.Method, path, request.URL.RawQuery)
+	}
+	var recorded RecordedResponse
+	err = json.Unmarshal(content, &recorded)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse recorded response '%s': %w", filename, err)
+	}
+	log.WithFields(log.Fields{
+		"filename": filename,
+		"path":     path,
+	}).Debug("Response replayed")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       request,
+	}, nil
+}
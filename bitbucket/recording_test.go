@@ -0,0 +1,58 @@
+package bitbucket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordAndReplayResponses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/context/1/2" {
+			t.Errorf("Invalid path '%v', expected '/context/1/2'", r.URL.Path)
+		}
+		w.Write([]byte(`{"arg": "` + r.URL.Query().Get("arg") + `"}`))
+	}))
+	directory := t.TempDir()
+
+	recording, err := NewRecordingTransport(directory, ts.URL+"/context", nil)
+	if err != nil {
+		t.Fatalf("NewRecordingTransport failed with error: %v", err)
+	}
+	req, err := NewRequest(ts.URL+"/context", "username", "password", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	req.Transport = recording
+	for _, arg := range []string{"a", "b"} {
+		values, err := req.RunWithArgs("GET", map[string]any{"arg": arg}, "1", "2")
+		if err != nil || values["arg"] != arg {
+			t.Fatalf("Recorded request failed with values %v and error: %v", values, err)
+		}
+	}
+	ts.Close()
+
+	// Replay with another base URL and the server already closed
+	replay, err := NewReplayTransport(directory, "http://replay/context")
+	if err != nil {
+		t.Fatalf("NewReplayTransport failed with error: %v", err)
+	}
+	req, err = NewRequest("http://replay/context", "", "", 100)
+	if err != nil {
+		t.Fatalf("NewRequest failed with error: %v", err)
+	}
+	req.Transport = replay
+	for _, arg := range []string{"a", "b"} {
+		values, err := req.RunWithArgs("GET", map[string]any{"arg": arg}, "1", "2")
+		if err != nil {
+			t.Fatalf("Replayed request failed with error: %v", err)
+		}
+		if values["arg"] != arg {
+			t.Errorf("Unexpected replayed value '%v', expected '%v'", values["arg"], arg)
+		}
+	}
+	_, err = req.RunWithArgs("GET", map[string]any{"arg": "not-recorded"}, "1", "2")
+	if err == nil {
+		t.Error("Replaying a not recorded request should fail")
+	}
+}
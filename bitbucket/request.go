@@ -4,9 +4,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -17,6 +17,8 @@ type Request struct {
 	Password         string
 	PageSize         int
 	BitbucketVersion string
+	Transport        http.RoundTripper
+	decodeFailures   atomic.Uint64
 }
 
 func NewRequest(baseURLString, username, password string, pageSize int) (*Request, error) {
@@ -41,6 +43,15 @@ func (request *Request) Run(verb string, subURIs ...string) (map[string]any, err
 }
 
 func (request *Request) RunWithArgs(verb string, args map[string]any, subURIs ...string) (map[string]any, error) {
+	var bodyJSON map[string]any
+	err := request.Decode(verb, args, &bodyJSON, subURIs...)
+	if err != nil {
+		return nil, err
+	}
+	return bodyJSON, nil
+}
+
+func (request *Request) Decode(verb string, args map[string]any, target any, subURIs ...string) error {
 	// Create the URL joining base URL + all received sub URIs
 	url := *(request.BaseURL)
 	url = *url.JoinPath(subURIs...)
@@ -58,7 +69,7 @@ func (request *Request) RunWithArgs(verb string, args map[string]any, subURIs ..
 			"url":   url.String(),
 			"error": err,
 		}).Error("Cannot create new HTTP request")
-		return nil, err
+		return err
 	}
 	// Now add headers, including authentication
 	auth := request.Username + ":" + request.Password
@@ -67,7 +78,9 @@ func (request *Request) RunWithArgs(verb string, args map[string]any, subURIs ..
 	httpRequest.Header.Add("Content-Type", "application/json")
 	httpRequest.Header.Add("charset", "UTF-8")
 	// Create the HTTP client and do the request to get a response
-	httpClient := &http.Client{}
+	httpClient := &http.Client{
+		Transport: request.Transport,
+	}
 	httpResponse, err := httpClient.Do(httpRequest)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -75,7 +88,7 @@ func (request *Request) RunWithArgs(verb string, args map[string]any, subURIs ..
 			"url":   url.String(),
 			"error": err,
 		}).Error("Cannot do HTTP request")
-		return nil, err
+		return err
 	}
 	defer httpResponse.Body.Close()
 
@@ -86,39 +99,31 @@ func (request *Request) RunWithArgs(verb string, args map[string]any, subURIs ..
 			"url":         url.String(),
 			"code-status": httpResponse.StatusCode,
 		}).Error("Unexpected HTTP status code")
-		return nil, err
-	}
-
-	// Read & parse the response body
-	rawBody, err := io.ReadAll(httpResponse.Body)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"verb":  verb,
-			"url":   url.String(),
-			"error": err,
-		}).Error("Cannot read HTTP response body")
-		return nil, err
+		return fmt.Errorf("unexpected HTTP status code %d for %s %s", httpResponse.StatusCode, verb, url.String())
 	}
-	body := string(rawBody)
 
-	var bodyJSON map[string]any
-	err = json.Unmarshal([]byte(body), &bodyJSON)
+	// Decode the response body while it is being read
+	decoder := json.NewDecoder(httpResponse.Body)
+	err = decoder.Decode(target)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"verb":        verb,
 			"url":         url.String(),
 			"code-status": httpResponse.StatusCode,
-			"body":        body,
+			"error":       err,
 		}).Error("Cannot parse JSON body")
-		return nil, err
+		return err
 	}
 
 	log.WithFields(log.Fields{
 		"verb":        verb,
 		"url":         url.String(),
 		"code-status": httpResponse.StatusCode,
-		"body-json":   bodyJSON,
 	}).Debug("Request was successfully executed")
 
-	return bodyJSON, nil
+	return nil
+}
+
+func (request *Request) DecodeFailures() uint64 {
+	return request.decodeFailures.Load()
 }
@@ -0,0 +1,90 @@
+package bitbucket
+
+import (
+	"maps"
+	"slices"
+)
+
+type ProjectPairKey struct {
+	project  string
+	author   string
+	reviewer string
+}
+
+func otherPair(key ProjectPairKey) ProjectPairKey {
+	key.author = OTHER_PERSON
+	key.reviewer = OTHER_PERSON
+	return key
+}
+
+func (identities *identities) normalizePairs(values map[ProjectPairKey]int) map[ProjectPairKey]int {
+	normalized := map[ProjectPairKey]int{}
+	for key, value := range values {
+		author, ok := identities.label(key.author)
+		if !ok {
+			continue
+		}
+		reviewer, ok := identities.label(key.reviewer)
+		if !ok {
+			continue
+		}
+		key.author = author
+		key.reviewer = reviewer
+		normalized[key] += value
+	}
+	return normalized
+}
+
+// gini tells how unequally values are spread, from 0 when all of them are equal to almost 1 when a single one has it all
+func gini(values []int) float64 {
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	if len(values) == 0 || total == 0 {
+		return 0
+	}
+	sorted := slices.Sorted(slices.Values(values))
+	weighted := 0
+	for i, value := range sorted {
+		weighted += (i + 1) * value
+	}
+	n := float64(len(sorted))
+	return 2*float64(weighted)/(n*float64(total)) - (n+1)/n
+}
+
+// reviewGini returns how concentrated reviews are on each repo among everyone authoring or reviewing its PRs,
+// so a single reviewer of many authors scores high
+func (collection *collection) reviewGini() map[ProjectRepoKey]float64 {
+	reviews := map[ProjectRepoKey]map[string]int{}
+	add := func(key ProjectRepoPersonKey, value int) {
+		person, ok := collection.identities.resolve(key.person)
+		if !ok {
+			return
+		}
+		repoKey := ProjectRepoKey{
+			project: key.project,
+			repo:    key.repo,
+		}
+		if _, ok := reviews[repoKey]; !ok {
+			reviews[repoKey] = map[string]int{}
+		}
+		reviews[repoKey][person] += value
+	}
+	// Counts decremented to 0 by webhooks are skipped, like persons missing from a full collection
+	for key, value := range collection.prsByAuthor {
+		if value > 0 {
+			add(key, 0)
+		}
+	}
+	for key, value := range collection.prsByReviewer {
+		if value > 0 {
+			add(key, value)
+		}
+	}
+	ginis := map[ProjectRepoKey]float64{}
+	for repoKey, persons := range reviews {
+		ginis[repoKey] = gini(slices.Collect(maps.Values(persons)))
+	}
+	return ginis
+}
@@ -3,159 +3,723 @@ package bitbucket
 import (
 	"bitbucket-metrics/config"
 	"bitbucket-metrics/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Runner struct {
-	config  *config.Config
-	request *Request
-	metrics *metrics.Metrics
+	config          *config.Config
+	request         *Request
+	metrics         *metrics.Metrics
+	commitHistories map[ProjectRepoKey]*commitHistory
+	prSizes         prCache[PRSize]
+	prActivities    prCache[prActivity]
+	prFirstCommits  prCache[time.Time]
+	releases        map[ProjectRepoKey]map[releaseCommit]bool
+	mutex           sync.Mutex
+	collection      *collection
+	afterCollect    []func(err error)
+	collectedAt     time.Time
+	pseudonymSalt   []byte
+	// Webhook changes received while collecting, replayed onto the new collection as it may have missed them
+	collecting     bool
+	webhookChanges []func(collection *collection)
 }
 
-func NewRunner(config *config.Config, request *Request, metrics *metrics.Metrics) {
-	runner := Runner{
-		config:  config,
-		request: request,
-		metrics: metrics,
+type cachedPR[T any] struct {
+	updated time.Time
+	value   T
+}
+
+type prCache[T any] map[ProjectRepoKey]map[int]cachedPR[T]
+
+func (cache prCache[T]) refresh(repoKey ProjectRepoKey, prs []PR, collection *collection, fetch func(pr PR) (T, error)) map[int]T {
+	// Only PRs updated since last collection need to be fetched again
+	cachedValues := cache[repoKey]
+	entries := map[int]cachedPR[T]{}
+	values := map[int]T{}
+	for _, pr := range prs {
+		entry, ok := cachedValues[pr.ID]
+		if !ok || !entry.updated.Equal(pr.Updated) {
+			value, err := fetch(pr)
+			if err != nil {
+				collection.errors = append(collection.errors, err)
+				continue
+			}
+			entry = cachedPR[T]{
+				updated: pr.Updated,
+				value:   value,
+			}
+		}
+		entries[pr.ID] = entry
+		values[pr.ID] = entry.value
 	}
-	go runner.Run()
+	cache[repoKey] = entries
+	return values
+}
+
+type commitHistory struct {
+	head    string
+	commits []Commit
+}
+
+func NewRunner(config *config.Config, request *Request, metrics *metrics.Metrics) *Runner {
+	runner := &Runner{
+		config:          config,
+		request:         request,
+		metrics:         metrics,
+		commitHistories: map[ProjectRepoKey]*commitHistory{},
+		prSizes:         prCache[PRSize]{},
+		prActivities:    prCache[prActivity]{},
+		prFirstCommits:  prCache[time.Time]{},
+		releases:        map[ProjectRepoKey]map[releaseCommit]bool{},
+	}
+	return runner
+}
+
+func (runner *Runner) AfterCollect(afterCollect func(err error)) {
+	runner.afterCollect = append(runner.afterCollect, afterCollect)
+}
+
+func (runner *Runner) Collect() error {
+	return runner.CollectContext(context.Background())
+}
+
+// CollectContext collects metrics unless the context is done, stopping before the next repository once it is
+func (runner *Runner) CollectContext(ctx context.Context) error {
+	err := runner.collectMetrics(ctx)
+	for _, afterCollect := range runner.afterCollect {
+		afterCollect(err)
+	}
+	return err
+}
+
+// CollectedAt tells when the last collection cycle ended, so its snapshot can be timestamped
+func (runner *Runner) CollectedAt() time.Time {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	return runner.collectedAt
 }
 
 func (runner *Runner) Run() {
-	runner.collectMetrics()
+	runner.RunContext(context.Background())
+}
+
+// RunContext collects metrics periodically until the context is done
+func (runner *Runner) RunContext(ctx context.Context) {
+	runner.CollectContext(ctx)
 
 	periodInSeconds := runner.config.Bitbucket.Metrics.PeriodInSeconds
 	ticker := time.NewTicker(time.Duration(periodInSeconds) * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		runner.collectMetrics()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runner.CollectContext(ctx)
+		}
 	}
 }
 
+type ProjectRepoKey struct {
+	project string
+	repo    string
+}
+
 type ProjectRepoPersonKey struct {
 	project string
 	repo    string
 	person  string
 }
 
-func (runner *Runner) collectPRs(project Project, repo Repo, prsByAuthor, prsByReviewer map[ProjectRepoPersonKey]int) {
+func (runner *Runner) collectPRs(project Project, repo Repo, collection *collection) ([]PR, error) {
 	log.WithFields(log.Fields{
 		"project": project.Key,
 		"repo":    repo.Name,
 	}).Info("Collecting PRs...")
-	prs, err := PRs(runner.request, project.Key, repo.Name)
-	if err == nil {
+	prs, err := PRs(runner.request, project.Key, repo.Slug)
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+	} else {
+		repoKey := ProjectRepoKey{
+			project: project.Key,
+			repo:    repo.Name,
+		}
+		if _, ok := collection.openPRs[repoKey]; !ok {
+			collection.openPRs[repoKey] = 0
+		}
+		if _, ok := collection.prsAwaitingReview[repoKey]; !ok {
+			collection.prsAwaitingReview[repoKey] = 0
+		}
 		for _, pr := range prs {
-			prKey := ProjectRepoPersonKey{
+			collection.addPR(project.Key, repo.Name, pr)
+		}
+		runner.countPRThroughput(repoKey, prs, collection, time.Now())
+	}
+	return prs, err
+}
+
+type ProjectRepoEventWindowKey struct {
+	project string
+	repo    string
+	event   string
+	window  string
+}
+
+var PR_EVENTS = []string{"opened", "merged", "declined"}
+
+// ParseWindow parses a time window like 24h, 7d (days aren't supported by durations) or 90m
+func ParseWindow(window string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(window, "d"); ok {
+		value, err := strconv.Atoi(days)
+		if err != nil || value <= 0 {
+			return 0, fmt.Errorf("invalid window '%s'", window)
+		}
+		return time.Duration(value) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid window '%s'", window)
+	}
+	return duration, nil
+}
+
+// prEvents returns when a PR was opened and, once closed, whether it was merged or declined and when
+func prEvents(pr PR) map[string]time.Time {
+	events := map[string]time.Time{
+		"opened": pr.Created,
+	}
+	closed := pr.Closed
+	if closed.IsZero() {
+		closed = pr.Updated
+	}
+	switch pr.State {
+	case "MERGED":
+		events["merged"] = closed
+	case "DECLINED":
+		events["declined"] = closed
+	}
+	return events
+}
+
+// recentPRs keeps the open PRs and those closed within the largest PR window, so the per PR requests don't grow with
+// the whole PR history
+func (runner *Runner) recentPRs(prs []PR) []PR {
+	var maxWindow time.Duration
+	for _, window := range runner.config.Bitbucket.Collectors.PRs.Windows {
+		if duration, err := ParseWindow(window); err == nil {
+			maxWindow = max(maxWindow, duration)
+		}
+	}
+	notBefore := time.Now().Add(-maxWindow)
+	return slices.DeleteFunc(slices.Clone(prs), func(pr PR) bool {
+		closed := pr.Closed
+		if closed.IsZero() {
+			closed = pr.Updated
+		}
+		return pr.State != "OPEN" && closed.Before(notBefore)
+	})
+}
+
+// countPRThroughput counts the PR events within each window until now, later ones aren't known yet when backfilling
+func (runner *Runner) countPRThroughput(repoKey ProjectRepoKey, prs []PR, collection *collection, now time.Time) {
+	for _, window := range runner.config.Bitbucket.Collectors.PRs.Windows {
+		duration, err := ParseWindow(window)
+		if err != nil {
+			continue
+		}
+		windowStart := now.Add(-duration)
+		// Every repo has all its events, so quiet repos are told apart from missing ones
+		for _, event := range PR_EVENTS {
+			collection.prThroughput[ProjectRepoEventWindowKey{
+				project: repoKey.project,
+				repo:    repoKey.repo,
+				event:   event,
+				window:  window,
+			}] += 0
+		}
+		for _, pr := range prs {
+			for event, date := range prEvents(pr) {
+				if date.IsZero() || date.Before(windowStart) || date.After(now) {
+					continue
+				}
+				collection.prThroughput[ProjectRepoEventWindowKey{
+					project: repoKey.project,
+					repo:    repoKey.repo,
+					event:   event,
+					window:  window,
+				}] += 1
+				collection.prThroughputByAuthor[ProjectRepoPersonWindowKey{
+					project: repoKey.project,
+					repo:    repoKey.repo,
+					person:  pr.Author,
+					event:   event,
+					window:  window,
+				}] += 1
+			}
+		}
+	}
+}
+
+func (runner *Runner) collectBranchesAndTags(project Project, repo Repo, collection *collection) []Reference {
+	log.WithFields(log.Fields{
+		"project": project.Key,
+		"repo":    repo.Name,
+	}).Info("Collecting branches & tags...")
+	branches, tags, err := References(runner.request, project.Key, repo.Slug)
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+	} else {
+		collection.addReferences(project.Key, repo.Name, branches)
+		collection.addReferences(project.Key, repo.Name, tags)
+	}
+	return tags
+}
+
+type ProjectRepoPersonWindowKey struct {
+	project string
+	repo    string
+	person  string
+	event   string
+	window  string
+}
+
+func (runner *Runner) collectCommits(project Project, repo Repo, collection *collection) {
+	log.WithFields(log.Fields{
+		"project": project.Key,
+		"repo":    repo.Name,
+	}).Info("Collecting commits...")
+	commitsConfig := runner.config.Bitbucket.Collectors.Commits
+	windows := runner.commitsWindows()
+	var ownershipWindow time.Duration
+	if commitsConfig.Ownership.Enabled {
+		ownershipWindow, _ = ParseWindow(commitsConfig.Ownership.Window)
+	}
+	maxWindow := ownershipWindow
+	for _, duration := range windows {
+		maxWindow = max(maxWindow, duration)
+	}
+	if maxWindow == 0 {
+		return
+	}
+	now := time.Now()
+	notBefore := now.Add(-maxWindow)
+
+	repoKey := ProjectRepoKey{
+		project: project.Key,
+		repo:    repo.Name,
+	}
+	history, ok := runner.commitHistories[repoKey]
+	if !ok || !commitsConfig.Watermark {
+		history = &commitHistory{}
+		runner.commitHistories[repoKey] = history
+	}
+	if history.head != "" {
+		// A force push can leave the watermark behind off the branch, so the history is rebuilt when it is no longer an ancestor
+		latest, err := LatestCommit(runner.request, project.Key, repo.Slug)
+		if err == nil && latest != history.head {
+			var contained bool
+			contained, err = ContainsCommit(runner.request, project.Key, repo.Slug, latest, history.head)
+			if err == nil && !contained {
+				history = &commitHistory{}
+				runner.commitHistories[repoKey] = history
+			}
+		}
+		if err != nil {
+			collection.errors = append(collection.errors, err)
+			delete(runner.commitHistories, repoKey)
+			return
+		}
+	}
+	commits, err := Commits(runner.request, project.Key, repo.Slug, history.head, notBefore)
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+		// The watermark could be gone (e.g. after a force push), so next time walk the whole window again
+		delete(runner.commitHistories, repoKey)
+		return
+	}
+	if len(commits) > 0 {
+		history.head = commits[0].ID
+	}
+	history.commits = append(commits, history.commits...)
+	history.commits = slices.DeleteFunc(history.commits, func(commit Commit) bool {
+		return commit.Timestamp.Before(notBefore)
+	})
+	collection.commits[repoKey] = history.commits
+	collection.commitsSince = notBefore
+
+	runner.countCommits(repoKey, history.commits, collection, now, notBefore)
+	if ownershipWindow > 0 {
+		windowStart := now.Add(-ownershipWindow)
+		for _, commit := range history.commits {
+			if commit.Timestamp.Before(windowStart) {
+				continue
+			}
+			commitKey := ProjectRepoPersonKey{
 				project: project.Key,
 				repo:    repo.Name,
-				person:  pr.Author,
-			}
-			if _, ok := prsByAuthor[prKey]; !ok {
-				prsByAuthor[prKey] = 0
+				person:  commit.Author,
 			}
-			prsByAuthor[prKey] += 1
+			collection.ownershipCommits[commitKey] += 1
+		}
+	}
+}
 
-			for _, reviewer := range pr.Reviewers {
-				prKey := ProjectRepoPersonKey{
-					project: project.Key,
-					repo:    repo.Name,
-					person:  reviewer,
-				}
-				if _, ok := prsByReviewer[prKey]; !ok {
-					prsByReviewer[prKey] = 0
-				}
-				prsByReviewer[prKey] += 1
+func (runner *Runner) commitsWindows() map[string]time.Duration {
+	windows := map[string]time.Duration{}
+	for _, window := range runner.config.Bitbucket.Collectors.Commits.Windows {
+		if duration, err := ParseWindow(window); err == nil {
+			windows[window] = duration
+		}
+	}
+	return windows
+}
+
+// countCommits counts the commits by author within each window until now, windows starting before the commits do are
+// left out as they would be partial
+func (runner *Runner) countCommits(repoKey ProjectRepoKey, commits []Commit, collection *collection, now time.Time, since time.Time) {
+	for window, duration := range runner.commitsWindows() {
+		windowStart := now.Add(-duration)
+		if windowStart.Before(since) {
+			continue
+		}
+		for _, commit := range commits {
+			if commit.Timestamp.Before(windowStart) || commit.Timestamp.After(now) {
+				continue
+			}
+			commitKey := ProjectRepoPersonWindowKey{
+				project: repoKey.project,
+				repo:    repoKey.repo,
+				person:  commit.Author,
+				window:  window,
 			}
+			collection.commitsByAuthor[commitKey] += 1
 		}
 	}
 }
 
-func (runner *Runner) collectReferences(project Project, repo Repo, references []Reference, referencesByAuthor map[ProjectRepoPersonKey]int) {
-	for _, reference := range references {
-		prKey := ProjectRepoPersonKey{
+type ProjectRepoSizeKey struct {
+	project string
+	repo    string
+	size    string
+}
+
+func (runner *Runner) prSizeName(size PRSize) string {
+	sizes := runner.config.Bitbucket.Collectors.PRSize.Sizes
+	for _, sizeName := range sizes {
+		if sizeName.MaxLines <= 0 || size.Lines() <= sizeName.MaxLines {
+			return sizeName.Name
+		}
+	}
+	return sizes[len(sizes)-1].Name
+}
+
+func (runner *Runner) collectPRSizes(project Project, repo Repo, prs []PR, collection *collection) {
+	if len(runner.config.Bitbucket.Collectors.PRSize.Sizes) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"project": project.Key,
+		"repo":    repo.Name,
+	}).Info("Collecting PR sizes...")
+	prs = runner.recentPRs(prs)
+	repoKey := ProjectRepoKey{
+		project: project.Key,
+		repo:    repo.Name,
+	}
+	sizes := runner.prSizes.refresh(repoKey, prs, collection, func(pr PR) (PRSize, error) {
+		return PRDiffStat(runner.request, project.Key, repo.Slug, pr.ID)
+	})
+	for _, pr := range prs {
+		size, ok := sizes[pr.ID]
+		if !ok {
+			continue
+		}
+		collection.prSizeLines[repoKey] = append(collection.prSizeLines[repoKey], float64(size.Lines()))
+		sizeKey := ProjectRepoSizeKey{
 			project: project.Key,
 			repo:    repo.Name,
-			person:  reference.Author,
+			size:    runner.prSizeName(size),
 		}
-		if _, ok := referencesByAuthor[prKey]; !ok {
-			referencesByAuthor[prKey] = 0
+		collection.prsBySize[sizeKey] += 1
+		authorKey := ProjectRepoPersonKey{
+			project: project.Key,
+			repo:    repo.Name,
+			person:  pr.Author,
 		}
-		referencesByAuthor[prKey] += 1
+		collection.linesAddedByAuthor[authorKey] += size.LinesAdded
+		collection.linesRemovedByAuthor[authorKey] += size.LinesRemoved
+		collection.filesChangedByAuthor[authorKey] += size.FilesChanged
 	}
 }
 
-func (runner *Runner) collectBranchesAndTags(project Project, repo Repo, branchesByAuthor, tagsByAuthor map[ProjectRepoPersonKey]int) {
+type prActivity struct {
+	comments []Comment
+	tasks    []Task
+}
+
+func (runner *Runner) collectPRActivities(project Project, repo Repo, prs []PR, collection *collection) {
 	log.WithFields(log.Fields{
 		"project": project.Key,
 		"repo":    repo.Name,
-	}).Info("Collecting branches & tags...")
-	branches, tags, err := References(runner.request, project.Key, repo.Name)
-	if err == nil {
-		runner.collectReferences(project, repo, branches, branchesByAuthor)
-		runner.collectReferences(project, repo, tags, tagsByAuthor)
+	}).Info("Collecting PR comments & tasks...")
+	prs = runner.recentPRs(prs)
+	repoKey := ProjectRepoKey{
+		project: project.Key,
+		repo:    repo.Name,
 	}
+	activities := runner.prActivities.refresh(repoKey, prs, collection, func(pr PR) (prActivity, error) {
+		comments, err := PRComments(runner.request, project.Key, repo.Slug, pr.ID)
+		if err != nil {
+			return prActivity{}, err
+		}
+		tasks, err := PRTasks(runner.request, project.Key, repo.Slug, pr.ID)
+		if err != nil {
+			return prActivity{}, err
+		}
+		return prActivity{
+			comments: comments,
+			tasks:    tasks,
+		}, nil
+	})
+	for _, pr := range prs {
+		activity, ok := activities[pr.ID]
+		if !ok {
+			continue
+		}
+		collection.prComments[repoKey] = append(collection.prComments[repoKey], float64(len(activity.comments)))
+		for _, comment := range activity.comments {
+			commenterKey := ProjectRepoPersonKey{
+				project: project.Key,
+				repo:    repo.Name,
+				person:  comment.Author,
+			}
+			collection.commentsByAuthor[commenterKey] += 1
+		}
+
+		openTasks, resolvedTasks := 0, 0
+		for _, task := range activity.tasks {
+			switch task.State {
+			case "OPEN":
+				openTasks += 1
+			case "RESOLVED":
+				resolvedTasks += 1
+			}
+		}
+		collection.prOpenTasks[repoKey] = append(collection.prOpenTasks[repoKey], float64(openTasks))
+		collection.prResolvedTasks[repoKey] = append(collection.prResolvedTasks[repoKey], float64(resolvedTasks))
+
+		participants := map[string]bool{
+			pr.Author: true,
+		}
+		for _, reviewer := range pr.Reviewers {
+			participants[reviewer] = true
+		}
+		for _, participant := range pr.Participants {
+			participants[participant] = true
+		}
+		collection.prParticipants[repoKey] = append(collection.prParticipants[repoKey], float64(len(participants)))
+	}
+}
+
+type ProjectRepoBuildKey struct {
+	project string
+	repo    string
+	key     string
+	state   string
+}
+
+func (runner *Runner) collectBuilds(project Project, repo Repo, prs []PR, collection *collection) {
+	log.WithFields(log.Fields{
+		"project": project.Key,
+		"repo":    repo.Name,
+	}).Info("Collecting builds...")
+	// Build statuses change without updating the PR, so they are never cached
+	for _, pr := range prs {
+		if pr.State != "OPEN" || pr.HeadCommit == "" {
+			continue
+		}
+		builds, err := Builds(runner.request, project.Key, repo.Slug, pr.HeadCommit)
+		if err != nil {
+			collection.errors = append(collection.errors, err)
+			continue
+		}
+		for _, build := range builds {
+			buildKey := ProjectRepoBuildKey{
+				project: project.Key,
+				repo:    repo.Name,
+				key:     build.Key,
+				state:   build.State,
+			}
+			collection.prBuilds[buildKey] += 1
+		}
+	}
+
+	commit, err := LatestCommit(runner.request, project.Key, repo.Slug)
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+		return
+	}
+	if commit == "" {
+		return
+	}
+	builds, err := Builds(runner.request, project.Key, repo.Slug, commit)
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+		return
+	}
+	for _, build := range builds {
+		buildKey := ProjectRepoBuildKey{
+			project: project.Key,
+			repo:    repo.Name,
+			key:     build.Key,
+			state:   build.State,
+		}
+		collection.defaultBranchBuilds[buildKey] += 1
+	}
+}
+
+func (runner *Runner) collectTeams(collection *collection) map[string][]string {
+	teams := map[string][]string{}
+	for _, team := range runner.config.Bitbucket.Teams {
+		members := slices.Clone(team.Members)
+		for _, group := range team.Groups {
+			log.WithFields(log.Fields{
+				"team":  team.Name,
+				"group": group,
+			}).Info("Collecting group members...")
+			groupMembers, err := GroupMembers(runner.request, group)
+			if err != nil {
+				collection.errors = append(collection.errors, err)
+				continue
+			}
+			members = append(members, groupMembers...)
+		}
+		for _, member := range members {
+			member = collection.identities.canonical(member)
+			if !slices.Contains(teams[member], team.Name) {
+				teams[member] = append(teams[member], team.Name)
+			}
+		}
+	}
+	return teams
 }
 
-func (runner *Runner) collectMetrics() {
+func (runner *Runner) collectMetrics(ctx context.Context) error {
 	start := time.Now()
+	decodeFailuresAtStart := runner.request.DecodeFailures()
 	log.Info("Collecting metrics...")
+	runner.mutex.Lock()
+	runner.collecting = true
+	runner.mutex.Unlock()
+	defer func() {
+		runner.mutex.Lock()
+		runner.collecting = false
+		runner.webhookChanges = nil
+		runner.mutex.Unlock()
+	}()
+	collection := newCollection()
+	collection.identities = runner.collectIdentities(collection)
+	collection.teams = runner.collectTeams(collection)
 	projects, err := Projects(runner.request, runner.config.Bitbucket.Projects.Include)
-	if err == nil {
-		projecstCount := len(projects)
-		reposCount := 0
-		prsByAuthor := map[ProjectRepoPersonKey]int{}
-		prsByReviewer := map[ProjectRepoPersonKey]int{}
-		branchesByAuthor := map[ProjectRepoPersonKey]int{}
-		tagsByAuthor := map[ProjectRepoPersonKey]int{}
+	if err != nil {
+		collection.errors = append(collection.errors, err)
+	} else {
+		collection.projectsCount = len(projects)
 		for _, project := range projects {
+			collection.projects = append(collection.projects, project)
+		}
+		collectors := runner.config.Bitbucket.Collectors
+		for _, project := range projects {
+			if ctx.Err() != nil {
+				break
+			}
 			log.WithFields(log.Fields{
 				"project": project.Key,
 			}).Info("Collecting repos...")
 			repos, err := Repos(runner.request, project.Key)
-			if err == nil {
-				reposCount += len(repos)
+			if err != nil {
+				collection.errors = append(collection.errors, err)
+			} else {
+				collection.reposCount += len(repos)
 				for _, repo := range repos {
-					runner.collectPRs(project, repo, prsByAuthor, prsByReviewer)
-					runner.collectBranchesAndTags(project, repo, branchesByAuthor, tagsByAuthor)
+					if ctx.Err() != nil {
+						break
+					}
+					collection.repos = append(collection.repos, ProjectRepo{
+						Project: project.Key,
+						Repo:    repo,
+					})
+					var prs []PR
+					var prsErr error
+					if collectors.PRs.Enabled {
+						prs, prsErr = runner.collectPRs(project, repo, collection)
+					}
+					// Without the PR listing the cached PR details are kept for next time
+					if collectors.PRSize.Enabled && prsErr == nil {
+						runner.collectPRSizes(project, repo, prs, collection)
+					}
+					if collectors.PRActivity.Enabled && prsErr == nil {
+						runner.collectPRActivities(project, repo, prs, collection)
+					}
+					if collectors.Builds.Enabled {
+						runner.collectBuilds(project, repo, prs, collection)
+					}
+					var tags []Reference
+					if collectors.References.Enabled {
+						tags = runner.collectBranchesAndTags(project, repo, collection)
+					}
+					if collectors.Commits.Enabled {
+						runner.collectCommits(project, repo, collection)
+					}
+					if collectors.DORA.Enabled {
+						runner.collectDORA(project, repo, prs, tags, collection)
+					}
 				}
 			}
 		}
-		runner.metrics.ProjectsGauge.Set(float64(projecstCount))
-		runner.metrics.RepositoriesGauge.Set(float64(reposCount))
-		for key, value := range prsByAuthor {
-			runner.metrics.PRsByAuthorGauge.WithLabelValues(
-				key.project,
-				key.repo,
-				key.person,
-			).Set(float64(value))
-		}
-		for key, value := range prsByReviewer {
-			runner.metrics.PRsByReviewerGauge.WithLabelValues(
-				key.project,
-				key.repo,
-				key.person,
-			).Set(float64(value))
-		}
-		for key, value := range branchesByAuthor {
-			runner.metrics.BranchesByAuthorGauge.WithLabelValues(
-				key.project,
-				key.repo,
-				key.person,
-			).Set(float64(value))
-		}
-		for key, value := range tagsByAuthor {
-			runner.metrics.TagsByAuthorGauge.WithLabelValues(
-				key.project,
-				key.repo,
-				key.person,
-			).Set(float64(value))
+		runner.mutex.Lock()
+		if ctx.Err() != nil {
+			// Cancelled collections are partial, so the last full one is kept published
+			collection.errors = append(collection.errors, ctx.Err())
+		} else {
+			for _, change := range runner.webhookChanges {
+				change(collection)
+			}
+			runner.collection = collection
+			runner.publish(collection)
 		}
+		runner.mutex.Unlock()
 	}
+	decodeFailures := runner.request.DecodeFailures() - decodeFailuresAtStart
+	runner.metrics.DecodeFailuresGauge.Set(float64(decodeFailures))
+	// A cancelled collection is no failed Bitbucket request
+	failedRequests := len(collection.errors)
+	if slices.Contains(collection.errors, ctx.Err()) {
+		failedRequests -= 1
+	}
+	runner.metrics.CollectErrorsGauge.Set(float64(failedRequests))
 	elapsed := time.Since(start)
 	runner.metrics.CollectTimeGauge.Set(float64(elapsed.Milliseconds()))
+	runner.mutex.Lock()
+	runner.collectedAt = start.Add(elapsed)
+	runner.mutex.Unlock()
+	if len(collection.errors) > 0 {
+		log.WithFields(log.Fields{
+			"errors": len(collection.errors),
+		}).Warnf("Metrics collected with errors in %v", elapsed)
+		return errors.Join(collection.errors...)
+	}
 	log.Infof("Metrics collected in %v", elapsed)
+	return nil
 }
@@ -0,0 +1,949 @@
+package bitbucket
+
+import (
+	"bitbucket-metrics/bitbucket/bitbucketfake"
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	alice = bitbucketfake.User{Name: "alice", Slug: "alice", DisplayName: "Alice"}
+	bob   = bitbucketfake.User{Name: "bob", Slug: "bob", DisplayName: "Bob"}
+)
+
+func newFakeBitbucket() *bitbucketfake.Server {
+	server := bitbucketfake.NewServer()
+	project1 := server.AddProject("P1", "Project 1")
+	repo1 := project1.AddRepo("repo-1", "Repo 1")
+	repo1.AddPR(bitbucketfake.PR{
+		Title:     "Awaiting review",
+		Author:    alice,
+		Reviewers: []bitbucketfake.Participant{{User: bob}},
+	})
+	repo1.AddPR(bitbucketfake.PR{
+		Title:     "Approved",
+		Author:    alice,
+		Reviewers: []bitbucketfake.Participant{{User: bob, Approved: true}},
+	})
+	repo1.AddPR(bitbucketfake.PR{
+		Title:     "Merged",
+		State:     "MERGED",
+		Author:    bob,
+		Reviewers: []bitbucketfake.Participant{{User: alice, Approved: true}},
+	})
+	repo1.AddRefChange(bitbucketfake.RefChange{User: alice, Ref: "feature-1"})
+	repo1.AddRefChange(bitbucketfake.RefChange{User: alice, Ref: "feature-2"})
+	repo1.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "v1.0.0", RefType: "TAG"})
+	project1.AddRepo("repo-2", "Repo 2")
+	project2 := server.AddProject("P2", "Project 2")
+	repo3 := project2.AddRepo("repo-3", "Repo 3")
+	repo3.AddPR(bitbucketfake.PR{
+		Title:  "Without reviewers",
+		Author: bob,
+	})
+	return server
+}
+
+func newFakeRunner(server *bitbucketfake.Server) *Runner {
+	// A small page size makes every listing span several pages
+	request := Init(server.URL(), "username", "password", 2)
+	config := &config.Config{}
+	config.Bitbucket.Collectors.PRs.Enabled = true
+	config.Bitbucket.Collectors.References.Enabled = true
+	return NewRunner(config, request, metrics.NewMetrics())
+}
+
+type expectedGauge struct {
+	name     string
+	value    float64
+	expected float64
+}
+
+func assertGauges(t *testing.T, gauges []expectedGauge) {
+	t.Helper()
+	for _, gauge := range gauges {
+		if gauge.value != gauge.expected {
+			t.Errorf("Unexpected %v %v, expected %v", gauge.name, gauge.value, gauge.expected)
+		}
+	}
+}
+
+func TestCollectMetricsFromFake(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	assertGauges(t, []expectedGauge{
+		{"projects", testutil.ToFloat64(runner.metrics.ProjectsGauge), 2},
+		{"repositories", testutil.ToFloat64(runner.metrics.RepositoriesGauge), 3},
+		{"P1/repo-1 open PRs", testutil.ToFloat64(runner.metrics.OpenPRsGauge.WithLabelValues("P1", "Repo 1")), 2},
+		{"P1/repo-1 PRs awaiting review", testutil.ToFloat64(runner.metrics.PRsAwaitingReviewGauge.WithLabelValues("P1", "Repo 1")), 1},
+		{"P1/repo-2 open PRs", testutil.ToFloat64(runner.metrics.OpenPRsGauge.WithLabelValues("P1", "Repo 2")), 0},
+		{"P2/repo-3 PRs awaiting review", testutil.ToFloat64(runner.metrics.PRsAwaitingReviewGauge.WithLabelValues("P2", "Repo 3")), 1},
+		{"P1/repo-1 PRs by alice", testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice")), 2},
+		{"P1/repo-1 PRs by bob", testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", "bob")), 1},
+		{"P1/repo-1 PRs reviewed by bob", testutil.ToFloat64(runner.metrics.PRsByReviewerGauge.WithLabelValues("P1", "Repo 1", "bob")), 2},
+		{"P1/repo-1 branches by alice", testutil.ToFloat64(runner.metrics.BranchesByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice")), 2},
+		{"P1/repo-1 tags by bob", testutil.ToFloat64(runner.metrics.TagsByAuthorGauge.WithLabelValues("P1", "Repo 1", "bob")), 1},
+		{"collect errors", testutil.ToFloat64(runner.metrics.CollectErrorsGauge), 0},
+		{"decode failures", testutil.ToFloat64(runner.metrics.DecodeFailuresGauge), 0},
+	})
+
+	// 3 PRs with a page size of 2 need 2 pages
+	if requests := server.Requests("/repos/repo-1/pull-requests"); requests != 2 {
+		t.Errorf("Unexpected %v requests for repo-1 PRs, expected 2", requests)
+	}
+}
+
+func TestCollectMetricsWithFaults(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+
+	server.InjectFault(bitbucketfake.Fault{
+		Path:   "/repos/repo-1/pull-requests",
+		Status: http.StatusInternalServerError,
+		Times:  1,
+	})
+	server.InjectFault(bitbucketfake.Fault{
+		Path:   "/repos/repo-3/ref-change-activities",
+		Status: http.StatusTooManyRequests,
+		Times:  1,
+	})
+	if err := runner.collectMetrics(context.Background()); err == nil {
+		t.Fatal("Expected a collect error")
+	}
+	if value := testutil.ToFloat64(runner.metrics.CollectErrorsGauge); value != 2 {
+		t.Errorf("Unexpected collect errors %v, expected 2", value)
+	}
+	// Other collectors of the same repo are not affected
+	if value := testutil.ToFloat64(runner.metrics.BranchesByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice")); value != 2 {
+		t.Errorf("Unexpected branches by alice %v, expected 2", value)
+	}
+
+	// Faults are exhausted, so next collection recovers
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if value := testutil.ToFloat64(runner.metrics.OpenPRsGauge.WithLabelValues("P1", "Repo 1")); value != 2 {
+		t.Errorf("Unexpected open PRs %v, expected 2", value)
+	}
+}
+
+func TestCollectMetricsWithSlowResponses(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+
+	delay := 50 * time.Millisecond
+	server.InjectFault(bitbucketfake.Fault{
+		Path:  "/projects",
+		Delay: delay,
+		Times: 1,
+	})
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if value := testutil.ToFloat64(runner.metrics.CollectTimeGauge); value < float64(delay.Milliseconds()) {
+		t.Errorf("Unexpected collect time %vms, expected at least %vms", value, delay.Milliseconds())
+	}
+}
+
+func TestCollectTeamsMetrics(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	server.AddGroup("qa-group", bob)
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Teams = []config.Team{
+		{Name: "core", Members: []string{"alice"}},
+		{Name: "qa", Groups: []string{"qa-group"}},
+	}
+	runner.metrics = metrics.NewMetricsWithOptions(metrics.Options{
+		Prefix:       "bitbucket",
+		PersonLabels: PersonLabels(runner.config),
+	})
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	assertGauges(t, []expectedGauge{
+		{"P1/repo-1 PRs by core", testutil.ToFloat64(runner.metrics.PRsByTeamGauge.WithLabelValues("P1", "Repo 1", "core")), 2},
+		{"P1/repo-1 PRs by qa", testutil.ToFloat64(runner.metrics.PRsByTeamGauge.WithLabelValues("P1", "Repo 1", "qa")), 1},
+		{"P2/repo-3 PRs by qa", testutil.ToFloat64(runner.metrics.PRsByTeamGauge.WithLabelValues("P2", "Repo 3", "qa")), 1},
+		{"P1/repo-1 PRs reviewed by core", testutil.ToFloat64(runner.metrics.PRsByReviewerTeamGauge.WithLabelValues("P1", "Repo 1", "core")), 1},
+		{"P1/repo-1 PRs reviewed by qa", testutil.ToFloat64(runner.metrics.PRsByReviewerTeamGauge.WithLabelValues("P1", "Repo 1", "qa")), 2},
+		{"P1/repo-1 branches by core", testutil.ToFloat64(runner.metrics.BranchesByTeamGauge.WithLabelValues("P1", "Repo 1", "core")), 2},
+		{"P1/repo-1 tags by qa", testutil.ToFloat64(runner.metrics.TagsByTeamGauge.WithLabelValues("P1", "Repo 1", "qa")), 1},
+		{"P1/repo-1 PRs by alice of core", testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice", "core")), 2},
+		{"P1/repo-1 PRs reviewed by bob of qa", testutil.ToFloat64(runner.metrics.PRsByReviewerGauge.WithLabelValues("P1", "Repo 1", "bob", "qa")), 2},
+	})
+	if count := testutil.CollectAndCount(runner.metrics.PRsByTeamGauge); count != 3 {
+		t.Errorf("Unexpected %v PRs by team series, expected 3", count)
+	}
+}
+
+func TestCollectNormalizesIdentities(t *testing.T) {
+	carol := bitbucketfake.User{Name: "Carol", Slug: "carol", DisplayName: "Carol Smith", Email: "carol@example.com"}
+	carolOld := bitbucketfake.User{Name: "carol.old", Slug: "carol.old"}
+	jenkins := bitbucketfake.User{Name: "jenkins", Slug: "jenkins", Service: true}
+	robot := bitbucketfake.User{Name: "release-bot", Slug: "release-bot"}
+
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	server.AddUser(carol, jenkins, robot)
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddPR(bitbucketfake.PR{Title: "By slug", Author: carol})
+	repo.AddPR(bitbucketfake.PR{Title: "By former account", Author: carolOld})
+	repo.AddPR(bitbucketfake.PR{Title: "By service user", Author: jenkins})
+	// References are labeled by name instead of slug
+	repo.AddRefChange(bitbucketfake.RefChange{User: carol, Ref: "feature-1"})
+	repo.AddRefChange(bitbucketfake.RefChange{User: robot, Ref: "v1.0.0", RefType: "TAG"})
+
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Identities = config.Identities{
+		Directory:           true,
+		Aliases:             map[string][]string{"carol": {"carol.old"}},
+		Exclude:             []string{"*-bot"},
+		ExcludeServiceUsers: true,
+		DisplayName:         true,
+	}
+	runner.config.Bitbucket.Teams = []config.Team{
+		{Name: "core", Members: []string{"carol@example.com"}},
+	}
+	runner.metrics = metrics.NewMetricsWithOptions(metrics.Options{
+		Prefix:       "bitbucket",
+		PersonLabels: PersonLabels(runner.config),
+	})
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	if count := testutil.CollectAndCount(runner.metrics.PRsByAuthorGauge); count != 1 {
+		t.Errorf("Unexpected %v PRs by author series, expected 1", count)
+	}
+	if value := testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", "carol", "Carol Smith", "core")); value != 2 {
+		t.Errorf("Unexpected PRs by carol %v, expected 2", value)
+	}
+	if value := testutil.ToFloat64(runner.metrics.BranchesByAuthorGauge.WithLabelValues("P1", "Repo 1", "carol", "Carol Smith", "core")); value != 1 {
+		t.Errorf("Unexpected branches by carol %v, expected 1", value)
+	}
+	if count := testutil.CollectAndCount(runner.metrics.TagsByAuthorGauge); count != 0 {
+		t.Errorf("Unexpected %v tags by author series, expected 0", count)
+	}
+	if value := testutil.ToFloat64(runner.metrics.PRsByTeamGauge.WithLabelValues("P1", "Repo 1", "core")); value != 2 {
+		t.Errorf("Unexpected PRs by core team %v, expected 2", value)
+	}
+}
+
+func TestCollectPseudonymizesPersons(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Identities.PersonLabels = "hash"
+	runner.Pseudonymize("salt")
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if value := testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice")); value != 0 {
+		t.Errorf("Unexpected PRs by alice %v, expected none", value)
+	}
+
+	pseudonym := runner.collection.identities.pseudonym("alice")
+	if value := testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", pseudonym)); value != 2 {
+		t.Errorf("Unexpected PRs by alice pseudonym %v, expected 2", value)
+	}
+	revealed, err := runner.Reveal([]string{pseudonym, "unknown"})
+	if err != nil {
+		t.Fatalf("Unexpected reveal error %v", err)
+	}
+	if revealed[pseudonym] != "alice" || len(revealed) != 1 {
+		t.Errorf("Unexpected revealed pseudonyms %v, expected only alice", revealed)
+	}
+}
+
+func TestCollectDropsPersons(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Identities.PersonLabels = "drop"
+	runner.config.Bitbucket.Teams = []config.Team{
+		{Name: "core", Members: []string{"alice"}},
+	}
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if count := testutil.CollectAndCount(runner.metrics.PRsByAuthorGauge); count != 0 {
+		t.Errorf("Unexpected %v PRs by author series, expected none", count)
+	}
+	if value := testutil.ToFloat64(runner.metrics.PRsByTeamGauge.WithLabelValues("P1", "Repo 1", "core")); value != 2 {
+		t.Errorf("Unexpected PRs by core team %v, expected 2", value)
+	}
+}
+
+func TestCollectSkipsDisabledCollectors(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.PRs.Enabled = false
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if requests := server.Requests("/pull-requests"); requests != 0 {
+		t.Errorf("Unexpected %v PRs requests, expected none", requests)
+	}
+	if value := testutil.ToFloat64(runner.metrics.BranchesByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice")); value != 2 {
+		t.Errorf("Unexpected branches by alice %v, expected 2", value)
+	}
+}
+
+func TestCollectFoldsPersonsOverCardinalityLimits(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Metrics.Cardinality = config.Cardinality{
+		TopPerRepo: 1,
+		Limits:     map[string]int{"pr_comments_by_author": 1},
+	}
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	assertGauges(t, []expectedGauge{
+		{"P1/repo-1 PRs by alice", testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice")), 2},
+		{"P1/repo-1 PRs by other", testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "Repo 1", OTHER_PERSON)), 1},
+		{"P2/repo-3 PRs by bob", testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P2", "Repo 3", "bob")), 1},
+		{"PRs by author folded series", testutil.ToFloat64(runner.metrics.FoldedSeriesGauge.WithLabelValues("prs_by_author")), 1},
+		{"PRs by reviewer folded series", testutil.ToFloat64(runner.metrics.FoldedSeriesGauge.WithLabelValues("prs_by_reviewer")), 1},
+	})
+	if count := testutil.CollectAndCount(runner.metrics.PRsByAuthorGauge); count != 3 {
+		t.Errorf("Unexpected %v PRs by author series, expected 3", count)
+	}
+}
+
+func TestBackfillReplaysDailySnapshots(t *testing.T) {
+	day := func(day int) time.Time {
+		return time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddPR(bitbucketfake.PR{
+		Title:   "Merged",
+		State:   "MERGED",
+		Author:  alice,
+		Created: day(1),
+		Updated: day(3),
+		Closed:  day(3),
+	})
+	repo.AddPR(bitbucketfake.PR{
+		Title:   "Open",
+		Author:  bob,
+		Created: day(2),
+		Updated: day(2),
+	})
+	repo.AddRefChange(bitbucketfake.RefChange{User: alice, Ref: "feature-1", Created: day(2)})
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.PRs.Windows = []string{"7d"}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	history := metrics.NewHistory()
+	if err := runner.Backfill(day(1), day(3), metrics.Options{Prefix: "bitbucket"}, history); err != nil {
+		t.Fatalf("Unexpected backfill error %v", err)
+	}
+	var output strings.Builder
+	if err := history.WriteOpenMetrics(&output); err != nil {
+		t.Fatalf("Unexpected write error %v", err)
+	}
+	expected := []string{
+		`bitbucket_open_prs{project="P1",repo="Repo 1"} 1.0 1.7040672e+09`,
+		`bitbucket_open_prs{project="P1",repo="Repo 1"} 2.0 1.7041536e+09`,
+		`bitbucket_open_prs{project="P1",repo="Repo 1"} 1.0 1.70424e+09`,
+		`bitbucket_prs_by_author{author="bob",project="P1",repo="Repo 1"} 1.0 1.7041536e+09`,
+		`bitbucket_branches_by_author{author="alice",project="P1",repo="Repo 1"} 1.0 1.7041536e+09`,
+		`bitbucket_pr_throughput{event="opened",project="P1",repo="Repo 1",window="7d"} 2.0 1.7041536e+09`,
+		`bitbucket_pr_throughput{event="merged",project="P1",repo="Repo 1",window="7d"} 0.0 1.7041536e+09`,
+		`bitbucket_pr_throughput{event="merged",project="P1",repo="Repo 1",window="7d"} 1.0 1.70424e+09`,
+		`bitbucket_pr_throughput_by_author{author="alice",event="merged",project="P1",repo="Repo 1",window="7d"} 1.0 1.70424e+09`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("Backfilled metrics lack '%v':\n%v", line, output.String())
+		}
+	}
+	// Only metrics which can be told for past days are backfilled
+	for _, name := range []string{"bitbucket_projects", "bitbucket_prs_awaiting_review", "bitbucket_review_queue"} {
+		if strings.Contains(output.String(), name) {
+			t.Errorf("Unexpected backfilled %v:\n%v", name, output.String())
+		}
+	}
+	if !strings.HasSuffix(output.String(), "# EOF\n") {
+		t.Errorf("Unexpected backfilled metrics:\n%v", output.String())
+	}
+}
+
+func TestBackfillCountsCommitsAndDeploymentsWithinWindows(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddCommit(
+		bitbucketfake.Commit{ID: "c1", Author: alice, Authored: yesterday.AddDate(0, 0, -2)},
+		bitbucketfake.Commit{ID: "c2", Author: alice, Authored: yesterday.Add(-12 * time.Hour)},
+		bitbucketfake.Commit{ID: "c3", Author: alice, Authored: today.Add(time.Minute)},
+	)
+	repo.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "v1.0.0", RefType: "TAG", Created: yesterday.AddDate(0, 0, -2)})
+	repo.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "v1.1.0", RefType: "TAG", Created: today.Add(time.Minute)})
+	runner := newFakeRunner(server)
+	collectors := &runner.config.Bitbucket.Collectors
+	collectors.Commits = config.Commits{
+		Enabled: true,
+		Windows: []string{"1d", "7d"},
+	}
+	collectors.DORA = config.DORA{
+		Enabled:     true,
+		ReleaseTags: []string{"v*"},
+		Windows:     []string{"7d"},
+	}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	history := metrics.NewHistory()
+	if err := runner.Backfill(yesterday, yesterday, metrics.Options{Prefix: "bitbucket"}, history); err != nil {
+		t.Fatalf("Unexpected backfill error %v", err)
+	}
+	var output strings.Builder
+	if err := history.WriteOpenMetrics(&output); err != nil {
+		t.Fatalf("Unexpected write error %v", err)
+	}
+	expected := []string{
+		`bitbucket_commits_by_author{author="alice",project="P1",repo="Repo 1",window="1d"} 1.0 `,
+		`bitbucket_deployments{project="P1",repo="Repo 1",window="7d"} 1.0 `,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("Backfilled metrics lack '%v':\n%v", line, output.String())
+		}
+	}
+	// Commits walked since 7 days ago can't tell the 7 days before yesterday
+	if strings.Contains(output.String(), `bitbucket_commits_by_author{author="alice",project="P1",repo="Repo 1",window="7d"}`) {
+		t.Errorf("Unexpected partial window backfilled:\n%v", output.String())
+	}
+}
+
+func TestCollectPRThroughputWithinWindows(t *testing.T) {
+	now := time.Now()
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddPR(bitbucketfake.PR{
+		Title:   "Opened & merged today",
+		State:   "MERGED",
+		Author:  alice,
+		Created: now.Add(-2 * time.Hour),
+		Closed:  now.Add(-time.Hour),
+	})
+	repo.AddPR(bitbucketfake.PR{
+		Title:   "Opened last week & declined today",
+		State:   "DECLINED",
+		Author:  bob,
+		Created: now.AddDate(0, 0, -5),
+		Closed:  now.Add(-3 * time.Hour),
+	})
+	repo.AddPR(bitbucketfake.PR{
+		Title:   "Opened last month",
+		Author:  alice,
+		Created: now.AddDate(0, 0, -20),
+	})
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.PRs.Windows = []string{"24h", "7d", "30d"}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	throughput := runner.metrics.PRThroughputGauge
+	throughputByAuthor := runner.metrics.PRThroughputByAuthorGauge
+	assertGauges(t, []expectedGauge{
+		{"opened in 24h", testutil.ToFloat64(throughput.WithLabelValues("P1", "Repo 1", "opened", "24h")), 1},
+		{"opened in 7d", testutil.ToFloat64(throughput.WithLabelValues("P1", "Repo 1", "opened", "7d")), 2},
+		{"opened in 30d", testutil.ToFloat64(throughput.WithLabelValues("P1", "Repo 1", "opened", "30d")), 3},
+		{"merged in 24h", testutil.ToFloat64(throughput.WithLabelValues("P1", "Repo 1", "merged", "24h")), 1},
+		{"declined in 24h", testutil.ToFloat64(throughput.WithLabelValues("P1", "Repo 1", "declined", "24h")), 1},
+		{"alice opened in 30d", testutil.ToFloat64(throughputByAuthor.WithLabelValues("P1", "Repo 1", "alice", "opened", "30d")), 2},
+		{"bob declined in 7d", testutil.ToFloat64(throughputByAuthor.WithLabelValues("P1", "Repo 1", "bob", "declined", "7d")), 1},
+	})
+}
+
+func TestCollectDORAMetrics(t *testing.T) {
+	now := time.Now()
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddPR(bitbucketfake.PR{
+		Title:  "Released",
+		State:  "MERGED",
+		Author: alice,
+		Commits: []bitbucketfake.Commit{
+			{ID: "c1", Author: alice, Authored: now.Add(-50 * time.Hour)},
+			{ID: "c2", Author: alice, Authored: now.Add(-49 * time.Hour)},
+		},
+		MergeCommit: "m1",
+		Created:     now.Add(-49 * time.Hour),
+		Closed:      now.Add(-48 * time.Hour),
+	})
+	repo.AddPR(bitbucketfake.PR{
+		Title:       "Not released yet",
+		State:       "MERGED",
+		Author:      bob,
+		Commits:     []bitbucketfake.Commit{{ID: "c3", Author: bob, Authored: now.Add(-3 * time.Hour)}},
+		MergeCommit: "m2",
+		Created:     now.Add(-3 * time.Hour),
+		Closed:      now.Add(-time.Hour),
+	})
+	repo.AddPR(bitbucketfake.PR{
+		Title:       "Merged into another branch",
+		State:       "MERGED",
+		Author:      bob,
+		Target:      "release/1.x",
+		Commits:     []bitbucketfake.Commit{{ID: "c4", Author: bob, Authored: now.Add(-30 * time.Hour)}},
+		MergeCommit: "r1",
+		Created:     now.Add(-30 * time.Hour),
+		Closed:      now.Add(-29 * time.Hour),
+	})
+	repo.AddCommit(
+		bitbucketfake.Commit{ID: "m0", Author: bob, Authored: now.AddDate(0, 0, -21)},
+		bitbucketfake.Commit{ID: "m1", Author: alice, Authored: now.Add(-48 * time.Hour)},
+		bitbucketfake.Commit{ID: "m2", Author: bob, Authored: now.Add(-time.Hour)},
+		// The release branch forks from the default one before the first PR merge
+		bitbucketfake.Commit{ID: "r1", Author: bob, Authored: now.Add(-29 * time.Hour), Parents: []string{"m0"}},
+	)
+	repo.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "v1.0.0", RefType: "TAG", Commit: "m1", Created: now.Add(-24 * time.Hour)})
+	repo.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "v0.9.1", RefType: "TAG", Commit: "r1", Created: now.Add(-28 * time.Hour)})
+	repo.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "v0.9.0", RefType: "TAG", Commit: "m0", Created: now.AddDate(0, 0, -20)})
+	repo.AddRefChange(bitbucketfake.RefChange{User: bob, Ref: "nightly", RefType: "TAG", Commit: "m2", Created: now.Add(-2 * time.Hour)})
+	doraConfig := config.DORA{
+		Enabled:        true,
+		ReleaseTags:    []string{"v*"},
+		Windows:        []string{"7d", "30d"},
+		LeadTimeWindow: "30d",
+	}
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.DORA = doraConfig
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	deployments := runner.metrics.DeploymentsGauge
+	if value := testutil.ToFloat64(deployments.WithLabelValues("P1", "Repo 1", "7d")); value != 2 {
+		t.Errorf("Unexpected %v deployments within 7d, expected 2", value)
+	}
+	if value := testutil.ToFloat64(deployments.WithLabelValues("P1", "Repo 1", "30d")); value != 3 {
+		t.Errorf("Unexpected %v deployments within 30d, expected 3", value)
+	}
+	// Just PRs merged into the default branch, the first one released a day after its merge by the first release
+	// containing it, not by the one cut from the release branch before
+	expected := `
+# HELP bitbucket_pr_lead_time_seconds Time from the first commit of Bitbucket PRs to their merge into the default branch
+# TYPE bitbucket_pr_lead_time_seconds histogram
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="14400"} 2
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="86400"} 2
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="172800"} 2
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="604800"} 2
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="1.2096e+06"} 2
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="2.592e+06"} 2
+bitbucket_pr_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="+Inf"} 2
+bitbucket_pr_lead_time_seconds_sum{project="P1",repo="Repo 1"} 14400
+bitbucket_pr_lead_time_seconds_count{project="P1",repo="Repo 1"} 2
+`
+	if err := testutil.CollectAndCompare(runner.metrics.PRLeadTimeHistogram, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected lead times: %v", err)
+	}
+	expected = `
+# HELP bitbucket_pr_release_lead_time_seconds Time from the merge of Bitbucket PRs into the default branch to the first release tag containing it
+# TYPE bitbucket_pr_release_lead_time_seconds histogram
+bitbucket_pr_release_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="86400"} 1
+bitbucket_pr_release_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="172800"} 1
+bitbucket_pr_release_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="604800"} 1
+bitbucket_pr_release_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="1.2096e+06"} 1
+bitbucket_pr_release_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="2.592e+06"} 1
+bitbucket_pr_release_lead_time_seconds_bucket{project="P1",repo="Repo 1",le="+Inf"} 1
+bitbucket_pr_release_lead_time_seconds_sum{project="P1",repo="Repo 1"} 86400
+bitbucket_pr_release_lead_time_seconds_count{project="P1",repo="Repo 1"} 1
+`
+	if err := testutil.CollectAndCompare(runner.metrics.PRReleaseLeadTimeHistogram, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected release lead times: %v", err)
+	}
+	// Release containment never changes, so it is not checked again
+	commitRequests := server.Requests("/repos/repo-1/commits")
+	if commitRequests == 0 {
+		t.Error("Expected release containment to be checked")
+	}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if requests := server.Requests("/repos/repo-1/commits"); requests != commitRequests {
+		t.Errorf("Unexpected %v commit requests, expected %v", requests, commitRequests)
+	}
+
+	// Without PRs & references collectors, DORA metrics get PRs & tags on their own
+	runner = newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.PRs.Enabled = false
+	runner.config.Bitbucket.Collectors.References.Enabled = false
+	runner.config.Bitbucket.Collectors.DORA = doraConfig
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if value := testutil.ToFloat64(runner.metrics.DeploymentsGauge.WithLabelValues("P1", "Repo 1", "7d")); value != 2 {
+		t.Errorf("Unexpected %v deployments within 7d without references collector, expected 2", value)
+	}
+	if count := testutil.CollectAndCount(runner.metrics.PRReleaseLeadTimeHistogram); count != 1 {
+		t.Errorf("Unexpected %v release lead time series without PRs collector, expected 1", count)
+	}
+}
+
+func TestCollectReviewMetrics(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	assertGauges(t, []expectedGauge{
+		{"alice PRs reviewed by bob", testutil.ToFloat64(runner.metrics.ReviewPairsGauge.WithLabelValues("P1", "alice", "bob")), 2},
+		{"bob PRs reviewed by alice", testutil.ToFloat64(runner.metrics.ReviewPairsGauge.WithLabelValues("P1", "bob", "alice")), 1},
+		{"bob review queue", testutil.ToFloat64(runner.metrics.ReviewQueueGauge.WithLabelValues("P1", "Repo 1", "bob")), 1},
+		{"repo-3 review gini", testutil.ToFloat64(runner.metrics.ReviewGiniGauge.WithLabelValues("P2", "Repo 3")), 0},
+	})
+	// Reviews of repo-1 are 1 by alice & 2 by bob
+	if value := testutil.ToFloat64(runner.metrics.ReviewGiniGauge.WithLabelValues("P1", "Repo 1")); math.Abs(value-1.0/6) > 1e-9 {
+		t.Errorf("Unexpected repo-1 review gini %v, expected 1/6", value)
+	}
+	// Merged PRs are out of the queue, approved ones too
+	if count := testutil.CollectAndCount(runner.metrics.ReviewQueueGauge); count != 1 {
+		t.Errorf("Unexpected %v review queue series, expected 1", count)
+	}
+}
+
+func TestGini(t *testing.T) {
+	cases := []struct {
+		values   []int
+		expected float64
+	}{
+		{nil, 0},
+		{[]int{0, 0}, 0},
+		{[]int{3, 3, 3}, 0},
+		{[]int{0, 0, 0, 4}, 0.75},
+	}
+	for _, c := range cases {
+		if value := gini(c.values); math.Abs(value-c.expected) > 1e-9 {
+			t.Errorf("Unexpected gini %v of %v, expected %v", value, c.values, c.expected)
+		}
+	}
+}
+
+func TestCollectOwnershipMetrics(t *testing.T) {
+	now := time.Now()
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	project := server.AddProject("P1", "Project 1")
+	repo1 := project.AddRepo("repo-1", "Repo 1")
+	repo1.AddCommit(
+		bitbucketfake.Commit{ID: "c1", Author: bob, Authored: now.AddDate(0, 0, -60)},
+		bitbucketfake.Commit{ID: "c2", Author: bob, Authored: now.AddDate(0, 0, -5)},
+		bitbucketfake.Commit{ID: "c3", Author: alice, Authored: now.AddDate(0, 0, -4)},
+		bitbucketfake.Commit{ID: "c4", Author: alice, Authored: now.AddDate(0, 0, -3)},
+		bitbucketfake.Commit{ID: "c5", Author: alice, Authored: now.AddDate(0, 0, -2)},
+		bitbucketfake.Commit{ID: "c6", Author: alice, Authored: now.AddDate(0, 0, -1)},
+	)
+	repo2 := project.AddRepo("repo-2", "Repo 2")
+	repo2.AddCommit(bitbucketfake.Commit{ID: "c7", Author: alice, Authored: now.AddDate(0, 0, -40)})
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.Commits = config.Commits{
+		Enabled: true,
+		Windows: []string{"7d"},
+		Ownership: config.Ownership{
+			Enabled:  true,
+			Window:   "30d",
+			Coverage: 0.9,
+		},
+	}
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	// Within 30 days alice authored 4 commits & bob 1, so both are needed to cover 90% of them
+	if value := testutil.ToFloat64(runner.metrics.BusFactorGauge.WithLabelValues("P1", "Repo 1")); value != 2 {
+		t.Errorf("Unexpected repo-1 bus factor %v, expected 2", value)
+	}
+	if value := testutil.ToFloat64(runner.metrics.TopContributorShareGauge.WithLabelValues("P1", "Repo 1")); value != 0.8 {
+		t.Errorf("Unexpected repo-1 top contributor share %v, expected 0.8", value)
+	}
+	// Repos without commits in the ownership window are not labeled
+	if count := testutil.CollectAndCount(runner.metrics.BusFactorGauge); count != 1 {
+		t.Errorf("Unexpected %v bus factor series, expected 1", count)
+	}
+}
+
+func TestBusFactor(t *testing.T) {
+	cases := []struct {
+		commits  []int
+		coverage float64
+		expected int
+	}{
+		{nil, 0.5, 0},
+		{[]int{10}, 0.5, 1},
+		{[]int{1, 8, 1}, 0.5, 1},
+		{[]int{1, 8, 1}, 0.9, 2},
+		{[]int{3, 3, 3, 3}, 0.5, 2},
+		{[]int{3, 3, 3, 3}, 1, 4},
+	}
+	for _, c := range cases {
+		if value := busFactor(c.commits, c.coverage); value != c.expected {
+			t.Errorf("Unexpected bus factor %v of %v covering %v, expected %v", value, c.commits, c.coverage, c.expected)
+		}
+	}
+}
+
+func TestCollectCommitsRebuildsHistoryAfterForcePush(t *testing.T) {
+	now := time.Now()
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddCommit(
+		bitbucketfake.Commit{ID: "c1", Author: alice, Authored: now.AddDate(0, 0, -3)},
+		bitbucketfake.Commit{ID: "c2", Author: alice, Authored: now.AddDate(0, 0, -2)},
+		bitbucketfake.Commit{ID: "c3", Author: alice, Authored: now.AddDate(0, 0, -1)},
+	)
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.Commits = config.Commits{
+		Enabled:   true,
+		Windows:   []string{"7d"},
+		Watermark: true,
+	}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	// c2 & c3 are rewritten on top of c1, the former head is still known but no longer on the branch
+	repo.AddCommit(
+		bitbucketfake.Commit{ID: "c2b", Author: alice, Authored: now.AddDate(0, 0, -2), Parents: []string{"c1"}},
+		bitbucketfake.Commit{ID: "c3b", Author: alice, Authored: now.AddDate(0, 0, -1)},
+	)
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	if value := testutil.ToFloat64(runner.metrics.CommitsByAuthorGauge.WithLabelValues("P1", "Repo 1", "alice", "7d")); value != 3 {
+		t.Errorf("Unexpected commits by alice %v, expected 3", value)
+	}
+}
+
+func TestCollectPRSizesOfRecentPRs(t *testing.T) {
+	now := time.Now()
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddPR(bitbucketfake.PR{Title: "Open", Author: alice, LinesAdded: 5, Created: now.AddDate(0, 0, -100)})
+	repo.AddPR(bitbucketfake.PR{Title: "Merged", State: "MERGED", Author: bob, LinesAdded: 20, Closed: now.AddDate(0, 0, -2)})
+	repo.AddPR(bitbucketfake.PR{Title: "Merged long ago", State: "MERGED", Author: bob, LinesAdded: 20, Closed: now.AddDate(0, 0, -60)})
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.PRs.Windows = []string{"7d", "30d"}
+	runner.config.Bitbucket.Collectors.PRSize = config.PRSize{
+		Enabled: true,
+		Sizes:   []config.PRSizeName{{Name: "S", MaxLines: 10}, {Name: "L"}},
+	}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	// PRs closed before the largest PR window aren't diffed anymore
+	if count := server.Requests("/pull-requests/3/diff"); count != 0 {
+		t.Errorf("Unexpected %v diffs of the PR merged long ago, expected 0", count)
+	}
+	for size, expected := range map[string]float64{"S": 1, "L": 1} {
+		if value := testutil.ToFloat64(runner.metrics.PRsBySizeGauge.WithLabelValues("P1", "Repo 1", size)); value != expected {
+			t.Errorf("Unexpected %v PRs of size %v, expected %v", value, size, expected)
+		}
+	}
+
+	// A failed listing keeps the cached sizes, so unchanged PRs aren't diffed again afterwards
+	server.InjectFault(bitbucketfake.Fault{
+		Path:   "/repos/repo-1/pull-requests",
+		Status: http.StatusInternalServerError,
+		Times:  1,
+	})
+	if err := runner.collectMetrics(context.Background()); err == nil {
+		t.Fatalf("Expected collect error")
+	}
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+	if count := server.Requests("/diff"); count != 2 {
+		t.Errorf("Unexpected %v diffs, expected 2", count)
+	}
+}
+
+func TestCollectPRActivitiesOfRecentPRs(t *testing.T) {
+	now := time.Now()
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "Repo 1")
+	repo.AddPR(bitbucketfake.PR{Title: "Open", Author: alice, Created: now.AddDate(0, 0, -100)})
+	repo.AddPR(bitbucketfake.PR{Title: "Merged", State: "MERGED", Author: bob, Closed: now.AddDate(0, 0, -2)})
+	repo.AddPR(bitbucketfake.PR{Title: "Merged long ago", State: "MERGED", Author: bob, Closed: now.AddDate(0, 0, -60)})
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Collectors.PRs.Windows = []string{"30d"}
+	runner.config.Bitbucket.Collectors.PRActivity.Enabled = true
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	for path, expected := range map[string]int{
+		"/pull-requests/1/activities":       1,
+		"/pull-requests/2/blocker-comments": 1,
+		"/pull-requests/3/activities":       0,
+		"/pull-requests/3/blocker-comments": 0,
+	} {
+		if count := server.Requests(path); count != expected {
+			t.Errorf("Unexpected %v requests of %v, expected %v", count, path, expected)
+		}
+	}
+}
+
+func TestPublishDropsVanishedSizeSeries(t *testing.T) {
+	runner := newWebhookTestRunner()
+	collection := newCollection()
+	collection.prsBySize[ProjectRepoSizeKey{project: "P1", repo: "Repo 1", size: "XS"}] = 1
+	collection.linesAddedByAuthor[ProjectRepoPersonKey{project: "P1", repo: "Repo 1", person: "alice"}] = 3
+	runner.publish(collection)
+
+	collection = newCollection()
+	collection.prsBySize[ProjectRepoSizeKey{project: "P1", repo: "Repo 1", size: "S"}] = 1
+	collection.linesAddedByAuthor[ProjectRepoPersonKey{project: "P1", repo: "Repo 1", person: "bob"}] = 30
+	runner.publish(collection)
+
+	if count := testutil.CollectAndCount(runner.metrics.PRsBySizeGauge); count != 1 {
+		t.Errorf("Unexpected %v PRs by size series, expected 1", count)
+	}
+	if count := testutil.CollectAndCount(runner.metrics.PRLinesAddedByAuthorGauge); count != 1 {
+		t.Errorf("Unexpected %v lines added by author series, expected 1", count)
+	}
+}
+
+func TestFoldPersonsKeepsOtherSeriesWithinMaxSeries(t *testing.T) {
+	values := map[ProjectRepoPersonKey]int{}
+	for repo := range 5 {
+		for person, value := range []int{4, 3, 2} {
+			key := ProjectRepoPersonKey{
+				project: "P1",
+				repo:    fmt.Sprintf("Repo %d", repo),
+				person:  fmt.Sprintf("person-%d", person),
+			}
+			values[key] = value + repo
+		}
+	}
+	for _, maxSeries := range []int{15, 10, 6, 5, 3} {
+		folded, _ := foldPersons(values, 0, maxSeries, otherPerson)
+		if len(folded) > maxSeries {
+			t.Errorf("Unexpected %v series over max series %v", len(folded), maxSeries)
+		}
+	}
+	// Without room for every repo, just the other series of the repos with highest values are kept
+	folded, foldedSeries := foldPersons(values, 0, 3, otherPerson)
+	for repo, expected := range map[string]int{"Repo 4": 21, "Repo 3": 18, "Repo 2": 15} {
+		if value := folded[ProjectRepoPersonKey{project: "P1", repo: repo, person: OTHER_PERSON}]; value != expected {
+			t.Errorf("Unexpected %v other series %v, expected %v", repo, value, expected)
+		}
+	}
+	if foldedSeries != 15 {
+		t.Errorf("Unexpected %v folded series, expected 15", foldedSeries)
+	}
+}
+
+func TestCollectKeepsSeriesWithinMaxSeries(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+	runner.config.Bitbucket.Metrics.Cardinality = config.Cardinality{
+		MaxSeries: 2,
+	}
+
+	if err := runner.collectMetrics(context.Background()); err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	for name, gauge := range map[string]*prometheus.GaugeVec{
+		"PRs by author":      runner.metrics.PRsByAuthorGauge,
+		"PRs by reviewer":    runner.metrics.PRsByReviewerGauge,
+		"branches by author": runner.metrics.BranchesByAuthorGauge,
+	} {
+		if count := testutil.CollectAndCount(gauge); count > 2 {
+			t.Errorf("Unexpected %v %v series over max series 2", count, name)
+		}
+	}
+}
+
+func TestCollectContextStopsWhenCancelled(t *testing.T) {
+	server := newFakeBitbucket()
+	defer server.Close()
+	runner := newFakeRunner(server)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := runner.CollectContext(ctx); err == nil {
+		t.Fatal("Expected an error on a cancelled collection")
+	}
+	// No repository is walked & the partial collection is not published
+	if requests := server.Requests("/pull-requests"); requests != 0 {
+		t.Errorf("Unexpected %v PR requests, expected 0", requests)
+	}
+	if count := testutil.CollectAndCount(runner.metrics.PRsByAuthorGauge); count != 0 {
+		t.Errorf("Unexpected %v PRs by author series, expected 0", count)
+	}
+	if value := testutil.ToFloat64(runner.metrics.CollectErrorsGauge); value != 0 {
+		t.Errorf("Unexpected %v collect errors, expected 0", value)
+	}
+}
+
+func TestReviewGiniSkipsPersonsWithoutReviews(t *testing.T) {
+	repoKey := ProjectRepoKey{project: "P1", repo: "Repo 1"}
+	polled := newCollection()
+	polled.prsByAuthor[ProjectRepoPersonKey{project: "P1", repo: "Repo 1", person: "alice"}] = 2
+	polled.prsByReviewer[ProjectRepoPersonKey{project: "P1", repo: "Repo 1", person: "bob"}] = 2
+	// Like a webhook removing the only PR reviewed by carol
+	updated := newCollection()
+	maps.Copy(updated.prsByAuthor, polled.prsByAuthor)
+	maps.Copy(updated.prsByReviewer, polled.prsByReviewer)
+	updated.prsByReviewer[ProjectRepoPersonKey{project: "P1", repo: "Repo 1", person: "carol"}] = 0
+
+	if polledGini, updatedGini := polled.reviewGini()[repoKey], updated.reviewGini()[repoKey]; polledGini != updatedGini {
+		t.Errorf("Unexpected webhook updated gini %v, expected %v like a full collection", updatedGini, polledGini)
+	}
+}
@@ -0,0 +1,192 @@
+package bitbucket
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const WEBHOOK_MAX_BODY_SIZE = 10 * 1024 * 1024
+
+type WebhookEventPayload struct {
+	EventKey    string              `json:"eventKey"`
+	Date        string              `json:"date"`
+	Actor       UserPayload         `json:"actor"`
+	PullRequest *PullRequestPayload `json:"pullRequest"`
+	Repository  *RepoPayload        `json:"repository"`
+	Changes     []RefChangePayload  `json:"changes"`
+}
+
+type WebhookHandler struct {
+	runner *Runner
+	secret []byte
+}
+
+func NewWebhookHandler(runner *Runner, secret string) *WebhookHandler {
+	return &WebhookHandler{
+		runner: runner,
+		secret: []byte(secret),
+	}
+}
+
+func (handler *WebhookHandler) validSignature(body []byte, signature string) bool {
+	// Bitbucket signs the body with HMAC SHA-256, hex encoded & prefixed by the algorithm
+	hexSignature, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	receivedSignature, err := hex.DecodeString(hexSignature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, handler.secret)
+	mac.Write(body)
+	return hmac.Equal(receivedSignature, mac.Sum(nil))
+}
+
+func (handler *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, WEBHOOK_MAX_BODY_SIZE))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot read webhook body")
+		http.Error(w, "Cannot read body", http.StatusBadRequest)
+		return
+	}
+	if !handler.validSignature(body, r.Header.Get("X-Hub-Signature")) {
+		log.WithFields(log.Fields{
+			"remote-address": r.RemoteAddr,
+		}).Warn("Webhook with invalid signature")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event WebhookEventPayload
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot parse webhook JSON body")
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if event.EventKey == "" {
+		event.EventKey = r.Header.Get("X-Event-Key")
+	}
+	log.WithFields(log.Fields{
+		"event": event.EventKey,
+	}).Debug("Webhook received")
+
+	switch event.EventKey {
+	case "pr:opened", "pr:merged", "pr:declined", "pr:reviewer:approved":
+		if event.PullRequest == nil {
+			http.Error(w, "Missing pull request", http.StatusBadRequest)
+			return
+		}
+		handler.runner.applyPR(*event.PullRequest)
+	case "repo:refs_changed":
+		if event.Repository == nil {
+			http.Error(w, "Missing repository", http.StatusBadRequest)
+			return
+		}
+		handler.runner.applyRefChanges(*event.Repository, event.Actor, event.Changes)
+	default:
+		log.WithFields(log.Fields{
+			"event": event.EventKey,
+		}).Debug("Ignored webhook event")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (runner *Runner) includesProject(project string) bool {
+	includeProjects := runner.config.Bitbucket.Projects.Include
+	return includeProjects == nil || slices.Contains(includeProjects, project)
+}
+
+// applyChange updates the published collection, and the running one too once it is done as it may have missed the change
+func (runner *Runner) applyChange(change func(collection *collection)) bool {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	if runner.collecting {
+		runner.webhookChanges = append(runner.webhookChanges, change)
+	}
+	// Until the first full collection is done there is nothing to update
+	if runner.collection == nil {
+		return false
+	}
+	change(runner.collection)
+	runner.publish(runner.collection)
+	return true
+}
+
+func (runner *Runner) applyPR(prPayload PullRequestPayload) {
+	if err := prPayload.Validate(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot apply webhook PR")
+		return
+	}
+	project := prPayload.ToRef.Repository.Project.Key
+	repo := prPayload.ToRef.Repository.Name
+	if !runner.includesProject(project) {
+		return
+	}
+
+	pr := NewPR(prPayload)
+	if !runner.applyChange(func(collection *collection) {
+		collection.addPR(project, repo, pr)
+	}) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"project": project,
+		"repo":    repo,
+		"id":      pr.ID,
+		"state":   pr.State,
+	}).Info("PR updated from webhook")
+}
+
+func (runner *Runner) applyRefChanges(repoPayload RepoPayload, actor UserPayload, changes []RefChangePayload) {
+	project := repoPayload.Project.Key
+	repo := repoPayload.Name
+	if !runner.includesProject(project) || actor.Name == "" {
+		return
+	}
+
+	var references []Reference
+	for _, change := range changes {
+		references = append(references, Reference{
+			Name:       change.Ref.DisplayID,
+			Type:       change.Ref.Type,
+			ChangeType: change.Type,
+			Commit:     change.ToHash,
+			Author:     actor.Name,
+			Created:    time.Now(),
+		})
+	}
+	if !runner.applyChange(func(collection *collection) {
+		// The collection may have listed the changes already
+		collection.addReferences(project, repo, slices.DeleteFunc(slices.Clone(references), func(reference Reference) bool {
+			return collection.hasReference(project, repo, reference)
+		}))
+	}) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"project":    project,
+		"repo":       repo,
+		"references": len(references),
+	}).Info("References updated from webhook")
+}
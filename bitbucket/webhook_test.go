@@ -0,0 +1,167 @@
+package bitbucket
+
+import (
+	"bitbucket-metrics/bitbucket/bitbucketfake"
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newWebhookTestRunner() *Runner {
+	return &Runner{
+		config:     &config.Config{},
+		metrics:    metrics.NewMetrics(),
+		collection: newCollection(),
+	}
+}
+
+func postWebhook(t *testing.T, handler http.Handler, secret string, body string) int {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	r := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	r.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func webhookPRBody(event string, state string, approved bool) string {
+	approvedJSON := "false"
+	if approved {
+		approvedJSON = "true"
+	}
+	return `{"eventKey": "` + event + `", "pullRequest": {"id": 1, "title": "PR 1", "state": "` + state + `", ` +
+		`"author": {"user": {"slug": "alice"}}, "reviewers": [{"user": {"slug": "bob"}, "approved": ` + approvedJSON + `}], ` +
+		`"toRef": {"repository": {"slug": "repo-1", "name": "repo-1", "project": {"key": "P1"}}}}}`
+}
+
+func TestWebhookRejectsInvalidSignature(t *testing.T) {
+	handler := NewWebhookHandler(newWebhookTestRunner(), "secret")
+	code := postWebhook(t, handler, "other-secret", webhookPRBody("pr:opened", "OPEN", false))
+	if code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status code %v, expected %v", code, http.StatusUnauthorized)
+	}
+}
+
+func TestWebhookAppliesPRLifecycle(t *testing.T) {
+	runner := newWebhookTestRunner()
+	handler := NewWebhookHandler(runner, "secret")
+
+	steps := []struct {
+		event             string
+		state             string
+		approved          bool
+		openPRs           float64
+		prsAwaitingReview float64
+	}{
+		{"pr:opened", "OPEN", false, 1, 1},
+		{"pr:reviewer:approved", "OPEN", true, 1, 0},
+		{"pr:merged", "MERGED", true, 0, 0},
+	}
+	for _, step := range steps {
+		code := postWebhook(t, handler, "secret", webhookPRBody(step.event, step.state, step.approved))
+		if code != http.StatusNoContent {
+			t.Fatalf("Unexpected status code %v on %v, expected %v", code, step.event, http.StatusNoContent)
+		}
+		if value := testutil.ToFloat64(runner.metrics.OpenPRsGauge.WithLabelValues("P1", "repo-1")); value != step.openPRs {
+			t.Errorf("Unexpected open PRs %v after %v, expected %v", value, step.event, step.openPRs)
+		}
+		if value := testutil.ToFloat64(runner.metrics.PRsAwaitingReviewGauge.WithLabelValues("P1", "repo-1")); value != step.prsAwaitingReview {
+			t.Errorf("Unexpected PRs awaiting review %v after %v, expected %v", value, step.event, step.prsAwaitingReview)
+		}
+		if value := testutil.ToFloat64(runner.metrics.PRsByAuthorGauge.WithLabelValues("P1", "repo-1", "alice")); value != 1 {
+			t.Errorf("Unexpected PRs by author %v after %v, expected 1", value, step.event)
+		}
+	}
+}
+
+func TestWebhookCountsRefChanges(t *testing.T) {
+	runner := newWebhookTestRunner()
+	handler := NewWebhookHandler(runner, "secret")
+
+	body := `{"eventKey": "repo:refs_changed", "actor": {"name": "alice"}, ` +
+		`"repository": {"slug": "repo-1", "name": "repo-1", "project": {"key": "P1"}}, "changes": [` +
+		`{"ref": {"displayId": "main", "type": "BRANCH"}, "type": "UPDATE"}, ` +
+		`{"ref": {"displayId": "v1.0.0", "type": "TAG"}, "type": "ADD"}]}`
+	code := postWebhook(t, handler, "secret", body)
+	if code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code %v, expected %v", code, http.StatusNoContent)
+	}
+	if value := testutil.ToFloat64(runner.metrics.BranchesByAuthorGauge.WithLabelValues("P1", "repo-1", "alice")); value != 1 {
+		t.Errorf("Unexpected branches by author %v, expected 1", value)
+	}
+	if value := testutil.ToFloat64(runner.metrics.TagsByAuthorGauge.WithLabelValues("P1", "repo-1", "alice")); value != 1 {
+		t.Errorf("Unexpected tags by author %v, expected 1", value)
+	}
+}
+
+func TestWebhookDropsFormerReviewers(t *testing.T) {
+	runner := newWebhookTestRunner()
+	handler := NewWebhookHandler(runner, "secret")
+
+	code := postWebhook(t, handler, "secret", webhookPRBody("pr:opened", "OPEN", false))
+	if code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code %v, expected %v", code, http.StatusNoContent)
+	}
+	// bob is replaced by carol as reviewer, so bob has no PR to review anymore
+	body := strings.Replace(webhookPRBody("pr:reviewer:approved", "OPEN", true), `"slug": "bob"`, `"slug": "carol"`, 1)
+	code = postWebhook(t, handler, "secret", body)
+	if code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code %v, expected %v", code, http.StatusNoContent)
+	}
+	if count := testutil.CollectAndCount(runner.metrics.PRsByReviewerGauge); count != 1 {
+		t.Errorf("Unexpected %v PRs by reviewer series, expected 1", count)
+	}
+	if value := testutil.ToFloat64(runner.metrics.PRsByReviewerGauge.WithLabelValues("P1", "repo-1", "carol")); value != 1 {
+		t.Errorf("Unexpected PRs reviewed by carol %v, expected 1", value)
+	}
+}
+
+func TestWebhookDuringCollectionIsReplayed(t *testing.T) {
+	server := bitbucketfake.NewServer()
+	defer server.Close()
+	repo := server.AddProject("P1", "Project 1").AddRepo("repo-1", "repo-1")
+	repo.AddPR(bitbucketfake.PR{
+		Title:     "PR 1",
+		Author:    alice,
+		Reviewers: []bitbucketfake.Participant{{User: bob}},
+	})
+	runner := newFakeRunner(server)
+	handler := NewWebhookHandler(runner, "secret")
+
+	// The PR listing is held back, so the PR is merged after the collection saw it open
+	server.InjectFault(bitbucketfake.Fault{
+		Path:  "/repos/repo-1/pull-requests",
+		Delay: 200 * time.Millisecond,
+		Times: 1,
+	})
+	collected := make(chan error)
+	go func() {
+		collected <- runner.collectMetrics(context.Background())
+	}()
+	for server.Requests("/repos/repo-1/pull-requests") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	code := postWebhook(t, handler, "secret", webhookPRBody("pr:merged", "MERGED", true))
+	if code != http.StatusNoContent {
+		t.Fatalf("Unexpected status code %v, expected %v", code, http.StatusNoContent)
+	}
+	if err := <-collected; err != nil {
+		t.Fatalf("Unexpected collect error %v", err)
+	}
+
+	if value := testutil.ToFloat64(runner.metrics.OpenPRsGauge.WithLabelValues("P1", "repo-1")); value != 0 {
+		t.Errorf("Unexpected open PRs %v, expected 0", value)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"flag"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func writeMetrics(registry *prometheus.Registry, output string) error {
+	if output == "" || output == "-" {
+		return metrics.WriteText(registry, os.Stdout)
+	}
+	// Write to a temporary file renamed at the end, so readers (like node_exporter) never see a partial file
+	file, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".*.tmp")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"output": output,
+			"error":  err,
+		}).Error("Cannot create temporary output file")
+		return err
+	}
+	defer os.Remove(file.Name())
+	// Temporary files are only readable by their owner, unlike the textfile collector user
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		log.WithFields(log.Fields{
+			"output": output,
+			"error":  err,
+		}).Error("Cannot make temporary output file readable")
+		return err
+	}
+	err = writeMetricsTo(registry, file)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(file.Name(), output)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"output": output,
+			"error":  err,
+		}).Error("Cannot rename temporary output file")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"output": output,
+	}).Info("Metrics written")
+	return nil
+}
+
+func writeMetricsTo(registry *prometheus.Registry, file *os.File) error {
+	err := metrics.WriteText(registry, file)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func collect(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("collect", flag.ExitOnError)
+	once := flags.Bool("once", false, "Collect metrics just once and exit, non-zero exit code on collection errors")
+	output := flags.String("output", "-", "File to write metrics in Prometheus text format to, '-' for stdout")
+	flags.Parse(args)
+
+	bitbucketRequestManager := initBitbucket(config)
+	metricsToBeCollected := metrics.NewMetricsWithOptions(metricsOptions(config))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsToBeCollected.Collectors()...)
+	runner := newRunner(config, bitbucketRequestManager, metricsToBeCollected)
+
+	if *once {
+		collectErr := runner.Collect()
+		err := writeMetrics(registry, *output)
+		if collectErr != nil || err != nil {
+			log.Error("Metrics collection failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Otherwise keep collecting periodically, rewriting the output after each collection
+	runner.AfterCollect(func(err error) {
+		writeMetrics(registry, *output)
+	})
+	runner.Run()
+}
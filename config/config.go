@@ -13,22 +13,174 @@ type Config struct {
 }
 
 type Bitbucket struct {
-	ApiPageSize int      `yaml:"api_page_size"`
-	Metrics     Metrics  `yaml:"metrics"`
-	Projects    Projects `yaml:"projects"`
+	ApiPageSize int         `yaml:"api_page_size"`
+	Metrics     Metrics     `yaml:"metrics"`
+	Projects    Projects    `yaml:"projects"`
+	Collectors  Collectors  `yaml:"collectors"`
+	Webhook     Webhook     `yaml:"webhook"`
+	Export      Export      `yaml:"export"`
+	Push        Push        `yaml:"push"`
+	OTLP        OTLP        `yaml:"otlp"`
+	RemoteWrite RemoteWrite `yaml:"remote_write"`
+	Sinks       Sinks       `yaml:"sinks"`
+	Teams       []Team      `yaml:"teams"`
+	Identities  Identities  `yaml:"identities"`
 }
 
 type Metrics struct {
-	Hostname        string `yaml:"hostname"`
-	Port            int    `yaml:"port"`
-	Path            string `yaml:"path"`
-	PeriodInSeconds int    `yaml:"period_in_seconds"`
+	Hostname          string            `yaml:"hostname"`
+	Port              int               `yaml:"port"`
+	Path              string            `yaml:"path"`
+	PeriodInSeconds   int               `yaml:"period_in_seconds"`
+	Prefix            string            `yaml:"prefix"`
+	ConstLabels       map[string]string `yaml:"const_labels"`
+	Disabled          []string          `yaml:"disabled"`
+	Cardinality       Cardinality       `yaml:"cardinality"`
+	RuntimeCollectors bool              `yaml:"runtime_collectors"`
+}
+
+type Cardinality struct {
+	MaxSeries  int            `yaml:"max_series"`
+	TopPerRepo int            `yaml:"top_per_repo"`
+	Limits     map[string]int `yaml:"limits"`
+}
+
+type Webhook struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+}
+
+type Export struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+}
+
+type Push struct {
+	URL      string `yaml:"url"`
+	Job      string `yaml:"job"`
+	Instance string `yaml:"instance"`
+	TLS      TLS    `yaml:"tls"`
+}
+
+type OTLP struct {
+	Enabled            bool              `yaml:"enabled"`
+	Protocol           string            `yaml:"protocol"`
+	Endpoint           string            `yaml:"endpoint"`
+	Headers            map[string]string `yaml:"headers"`
+	IntervalInSeconds  int               `yaml:"interval_in_seconds"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+}
+
+type RemoteWrite struct {
+	Enabled          bool   `yaml:"enabled"`
+	URL              string `yaml:"url"`
+	Retries          int    `yaml:"retries"`
+	BackoffInSeconds int    `yaml:"backoff_in_seconds"`
+	TimeoutInSeconds int    `yaml:"timeout_in_seconds"`
+	TLS              TLS    `yaml:"tls"`
+}
+
+type Sinks struct {
+	InfluxDB InfluxDB `yaml:"influxdb"`
+	StatsD   StatsD   `yaml:"statsd"`
+}
+
+type InfluxDB struct {
+	Enabled          bool   `yaml:"enabled"`
+	URL              string `yaml:"url"`
+	TimeoutInSeconds int    `yaml:"timeout_in_seconds"`
+	TLS              TLS    `yaml:"tls"`
+}
+
+type StatsD struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"`
+	Flavor  string `yaml:"flavor"`
+}
+
+type TLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 }
 
 type Projects struct {
 	Include []string `yaml:"include"`
 }
 
+type Team struct {
+	Name    string   `yaml:"name"`
+	Members []string `yaml:"members"`
+	Groups  []string `yaml:"groups"`
+}
+
+type Identities struct {
+	Directory           bool                `yaml:"directory"`
+	Aliases             map[string][]string `yaml:"aliases"`
+	Exclude             []string            `yaml:"exclude"`
+	ExcludeServiceUsers bool                `yaml:"exclude_service_users"`
+	DisplayName         bool                `yaml:"display_name"`
+	PersonLabels        string              `yaml:"person_labels"`
+}
+
+type Collectors struct {
+	PRs        PRs        `yaml:"prs"`
+	References References `yaml:"references"`
+	Commits    Commits    `yaml:"commits"`
+	PRSize     PRSize     `yaml:"pr_size"`
+	PRActivity PRActivity `yaml:"pr_activity"`
+	Builds     Builds     `yaml:"builds"`
+	DORA       DORA       `yaml:"dora"`
+}
+
+type PRs struct {
+	Enabled bool     `yaml:"enabled"`
+	Windows []string `yaml:"windows"`
+}
+
+type References struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type Commits struct {
+	Enabled   bool      `yaml:"enabled"`
+	Windows   []string  `yaml:"windows"`
+	Watermark bool      `yaml:"watermark"`
+	Ownership Ownership `yaml:"ownership"`
+}
+
+type Ownership struct {
+	Enabled  bool    `yaml:"enabled"`
+	Window   string  `yaml:"window"`
+	Coverage float64 `yaml:"coverage"`
+}
+
+type PRSize struct {
+	Enabled bool         `yaml:"enabled"`
+	Sizes   []PRSizeName `yaml:"sizes"`
+}
+
+type PRSizeName struct {
+	Name     string `yaml:"name"`
+	MaxLines int    `yaml:"max_lines"`
+}
+
+type PRActivity struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type DORA struct {
+	Enabled        bool     `yaml:"enabled"`
+	ReleaseTags    []string `yaml:"release_tags"`
+	Windows        []string `yaml:"windows"`
+	LeadTimeWindow string   `yaml:"lead_time_window"`
+}
+
+type Builds struct {
+	Enabled bool `yaml:"enabled"`
+}
+
 func ReadConfig(filename string) (*Config, error) {
 	file, err := os.ReadFile(filename)
 	if err != nil {
@@ -47,10 +199,90 @@ func ReadConfig(filename string) (*Config, error) {
 				Port:            8080,
 				Path:            "/metrics",
 				PeriodInSeconds: 600,
+				Prefix:          "bitbucket",
+			},
+			Webhook: Webhook{
+				Enabled: false,
+				Path:    "/webhook",
+			},
+			Export: Export{
+				Enabled: false,
+				Path:    "/export",
+			},
+			Push: Push{
+				URL:      "http://localhost:9091",
+				Job:      "bitbucket-metrics",
+				Instance: "",
+			},
+			OTLP: OTLP{
+				Enabled:           false,
+				Protocol:          "http",
+				Endpoint:          "http://localhost:4318",
+				IntervalInSeconds: 60,
+			},
+			RemoteWrite: RemoteWrite{
+				Enabled:          false,
+				URL:              "http://localhost:9009/api/v1/push",
+				Retries:          3,
+				BackoffInSeconds: 1,
+				TimeoutInSeconds: 30,
+			},
+			Sinks: Sinks{
+				InfluxDB: InfluxDB{
+					Enabled:          false,
+					URL:              "http://localhost:8086/api/v2/write?org=org&bucket=bitbucket&precision=ns",
+					TimeoutInSeconds: 30,
+				},
+				StatsD: StatsD{
+					Enabled: false,
+					Address: "localhost:8125",
+					Flavor:  "statsd",
+				},
 			},
 			Projects: Projects{
 				Include: nil,
 			},
+			Identities: Identities{
+				Directory:           false,
+				ExcludeServiceUsers: true,
+				DisplayName:         false,
+				PersonLabels:        "keep",
+			},
+			Collectors: Collectors{
+				PRs: PRs{
+					Enabled: true,
+					Windows: []string{"24h", "7d", "30d"},
+				},
+				References: References{
+					Enabled: true,
+				},
+				Commits: Commits{
+					Enabled:   false,
+					Windows:   []string{"7d", "30d", "90d"},
+					Watermark: true,
+					Ownership: Ownership{
+						Enabled:  true,
+						Window:   "90d",
+						Coverage: 0.5,
+					},
+				},
+				PRSize: PRSize{
+					Enabled: false,
+					Sizes: []PRSizeName{
+						{Name: "XS", MaxLines: 10},
+						{Name: "S", MaxLines: 100},
+						{Name: "M", MaxLines: 500},
+						{Name: "L", MaxLines: 1000},
+						{Name: "XL", MaxLines: 0},
+					},
+				},
+				DORA: DORA{
+					Enabled:        false,
+					ReleaseTags:    []string{"v*"},
+					Windows:        []string{"7d", "30d"},
+					LeadTimeWindow: "30d",
+				},
+			},
 		},
 	}
 	err = yaml.Unmarshal(file, &config)
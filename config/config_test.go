@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"slices"
 	"strconv"
 	"testing"
 )
@@ -98,3 +99,67 @@ func TestReadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestReadConfigDefaultCollectors(t *testing.T) {
+	filename := createTempConfig(t, "bitbucket:\n")
+	defer os.Remove(filename)
+
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatalf("Fail to read testing config %v", filename)
+	}
+	if !config.Bitbucket.Collectors.PRs.Enabled || !config.Bitbucket.Collectors.References.Enabled {
+		t.Error("bitbucket.collectors.prs.enabled & bitbucket.collectors.references.enabled should be true by default")
+	}
+	if !slices.Equal(config.Bitbucket.Collectors.PRs.Windows, []string{"24h", "7d", "30d"}) {
+		t.Errorf("bitbucket.collectors.prs.windows should be 24h, 7d & 30d by default instead of %v", config.Bitbucket.Collectors.PRs.Windows)
+	}
+	if config.Bitbucket.Metrics.Prefix != "bitbucket" {
+		t.Errorf("bitbucket.metrics.prefix should be bitbucket by default instead of %v", config.Bitbucket.Metrics.Prefix)
+	}
+	commits := config.Bitbucket.Collectors.Commits
+	if commits.Enabled {
+		t.Error("bitbucket.collectors.commits.enabled should be false by default")
+	}
+	if !commits.Watermark {
+		t.Error("bitbucket.collectors.commits.watermark should be true by default")
+	}
+	if !slices.Equal(commits.Windows, []string{"7d", "30d", "90d"}) {
+		t.Errorf("bitbucket.collectors.commits.windows should be [7d 30d 90d] instead of %v", commits.Windows)
+	}
+	if !commits.Ownership.Enabled || commits.Ownership.Window != "90d" || commits.Ownership.Coverage != 0.5 {
+		t.Errorf("bitbucket.collectors.commits.ownership should be enabled over 90d covering 0.5 instead of %+v", commits.Ownership)
+	}
+	prSize := config.Bitbucket.Collectors.PRSize
+	if prSize.Enabled {
+		t.Error("bitbucket.collectors.pr_size.enabled should be false by default")
+	}
+	if len(prSize.Sizes) != 5 || prSize.Sizes[0].Name != "XS" || prSize.Sizes[4].Name != "XL" || prSize.Sizes[4].MaxLines != 0 {
+		t.Errorf("bitbucket.collectors.pr_size.sizes should be XS to XL instead of %v", prSize.Sizes)
+	}
+}
+
+func TestReadConfigCommitsCollector(t *testing.T) {
+	filename := createTempConfig(t, "bitbucket:\n"+
+		"  collectors:\n"+
+		"    commits:\n"+
+		"      enabled: true\n"+
+		"      windows: [1d]\n"+
+		"      watermark: false\n")
+	defer os.Remove(filename)
+
+	config, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatalf("Fail to read testing config %v", filename)
+	}
+	commits := config.Bitbucket.Collectors.Commits
+	if !commits.Enabled {
+		t.Error("bitbucket.collectors.commits.enabled should be true")
+	}
+	if commits.Watermark {
+		t.Error("bitbucket.collectors.commits.watermark should be false")
+	}
+	if !slices.Equal(commits.Windows, []string{"1d"}) {
+		t.Errorf("bitbucket.collectors.commits.windows should be [1d] instead of %v", commits.Windows)
+	}
+}
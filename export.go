@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bitbucket-metrics/bitbucket"
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"flag"
+	"os"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func export(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "Records format: 'jsonl' or 'csv'")
+	output := flags.String("output", "-", "File to write records to, '-' for stdout")
+	flags.Parse(args)
+	// Check the format before spending a whole collection on it
+	if !slices.Contains(bitbucket.EXPORT_FORMATS, *format) {
+		log.Fatalf("Unknown export format '%s', valid ones are %v", *format, bitbucket.EXPORT_FORMATS)
+	}
+
+	bitbucketRequestManager := initBitbucket(config)
+	runner := newRunner(config, bitbucketRequestManager, metrics.NewMetrics())
+	collectErr := runner.Collect()
+
+	if *output == "" || *output == "-" {
+		err := runner.Export(os.Stdout, *format)
+		if err != nil || collectErr != nil {
+			log.Error("Records export failed")
+			os.Exit(1)
+		}
+		return
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"output": *output,
+			"error":  err,
+		}).Fatal("Cannot create output file")
+	}
+	err = runner.Export(file, *format)
+	// Records are only safe once the file is closed, so a failed close fails the export too
+	closeErr := file.Close()
+	if closeErr != nil {
+		log.WithFields(log.Fields{
+			"output": *output,
+			"error":  closeErr,
+		}).Error("Cannot close output file")
+	}
+	if err != nil || closeErr != nil || collectErr != nil {
+		log.Error("Records export failed")
+		os.Exit(1)
+	}
+}
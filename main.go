@@ -4,9 +4,13 @@ import (
 	"bitbucket-metrics/bitbucket"
 	"bitbucket-metrics/config"
 	"bitbucket-metrics/metrics"
+	"context"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -58,6 +62,142 @@ func parseLogLevel(level string) log.Level {
 	return log.InfoLevel
 }
 
+func initBitbucket(config *config.Config) *bitbucket.Request {
+	apiPageSize := config.Bitbucket.ApiPageSize
+
+	// Replaying recorded responses needs no Bitbucket at all
+	replayDirectory := getEnvOrDefault("REPLAY_DIR", "")
+	if replayDirectory != "" {
+		bitbucketBaseURL := getEnvOrDefault("BASE_URL", "http://replay")
+		transport, err := bitbucket.NewReplayTransport(replayDirectory, bitbucketBaseURL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"directory": replayDirectory,
+				"error":     err,
+			}).Panic("Cannot replay recorded responses")
+		}
+		log.WithFields(log.Fields{
+			"directory": replayDirectory,
+		}).Info("Replaying recorded Bitbucket responses")
+		return bitbucket.InitWithTransport(bitbucketBaseURL, "", "", apiPageSize, transport)
+	}
+
+	bitbucketBaseURL := getEnvOrPanic("BASE_URL")
+	username := getEnvOrPanic("USERNAME")
+	password := getEnvOrPanic("PASSWORD")
+	recordDirectory := getEnvOrDefault("RECORD_DIR", "")
+	if recordDirectory != "" {
+		transport, err := bitbucket.NewRecordingTransport(recordDirectory, bitbucketBaseURL, nil)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"directory": recordDirectory,
+				"error":     err,
+			}).Panic("Cannot record Bitbucket responses")
+		}
+		log.WithFields(log.Fields{
+			"directory": recordDirectory,
+		}).Info("Recording Bitbucket responses")
+		return bitbucket.InitWithTransport(bitbucketBaseURL, username, password, apiPageSize, transport)
+	}
+	return bitbucket.Init(bitbucketBaseURL, username, password, apiPageSize)
+}
+
+func newRunner(config *config.Config, request *bitbucket.Request, metrics *metrics.Metrics) *bitbucket.Runner {
+	runner := bitbucket.NewRunner(config, request, metrics)
+	personLabels := config.Bitbucket.Identities.PersonLabels
+	if !slices.Contains(bitbucket.PERSON_LABELS, personLabels) {
+		log.Panicf("Unknown person labels '%s', valid ones are %v", personLabels, bitbucket.PERSON_LABELS)
+	}
+	if personLabels == "hash" {
+		runner.Pseudonymize(getEnvOrPanic("PSEUDONYM_SALT"))
+	}
+	collectors := config.Bitbucket.Collectors
+	windows := slices.Concat(collectors.PRs.Windows, collectors.Commits.Windows)
+	ownership := collectors.Commits.Ownership
+	if ownership.Enabled {
+		windows = append(windows, ownership.Window)
+	}
+	if collectors.DORA.Enabled {
+		windows = append(windows, collectors.DORA.Windows...)
+		windows = append(windows, collectors.DORA.LeadTimeWindow)
+	}
+	for _, window := range windows {
+		if _, err := bitbucket.ParseWindow(window); err != nil {
+			log.Panicf("Invalid window '%s', expected like 24h or 7d", window)
+		}
+	}
+	if ownership.Enabled && (ownership.Coverage <= 0 || ownership.Coverage > 1) {
+		log.Panicf("Invalid ownership coverage %v, expected within (0, 1]", ownership.Coverage)
+	}
+	return runner
+}
+
+func metricsOptions(config *config.Config) metrics.Options {
+	return metrics.Options{
+		Prefix:            config.Bitbucket.Metrics.Prefix,
+		ConstLabels:       config.Bitbucket.Metrics.ConstLabels,
+		Disabled:          config.Bitbucket.Metrics.Disabled,
+		PersonLabels:      bitbucket.PersonLabels(config),
+		RuntimeCollectors: config.Bitbucket.Metrics.RuntimeCollectors,
+	}
+}
+
+func tlsOptions(tls config.TLS) metrics.TLSOptions {
+	return metrics.TLSOptions{
+		CAFile:             tls.CAFile,
+		CertFile:           tls.CertFile,
+		KeyFile:            tls.KeyFile,
+		InsecureSkipVerify: tls.InsecureSkipVerify,
+	}
+}
+
+func serve(config *config.Config) {
+	bitbucketRequestManager := initBitbucket(config)
+
+	hostname := config.Bitbucket.Metrics.Hostname
+	metricsPortNumber := uint16(config.Bitbucket.Metrics.Port)
+	metricsPath := config.Bitbucket.Metrics.Path
+	server := metrics.NewServer(hostname, metricsPortNumber, metricsPath, metricsOptions(config))
+	runner := newRunner(config, bitbucketRequestManager, server.Metrics)
+	if config.Bitbucket.Webhook.Enabled {
+		webhookSecret := getEnvOrPanic("WEBHOOK_SECRET")
+		server.Handle(config.Bitbucket.Webhook.Path, bitbucket.NewWebhookHandler(runner, webhookSecret))
+		log.WithFields(log.Fields{
+			"path": config.Bitbucket.Webhook.Path,
+		}).Info("Receiving Bitbucket webhooks via HTTP")
+	}
+	if config.Bitbucket.Export.Enabled {
+		server.Handle(config.Bitbucket.Export.Path, bitbucket.NewExportHandler(runner))
+		log.WithFields(log.Fields{
+			"path": config.Bitbucket.Export.Path,
+		}).Info("Exporting collected records via HTTP")
+	}
+	if config.Bitbucket.OTLP.Enabled {
+		exporter := startOTLP(config, bitbucketRequestManager, server.Registry)
+		runner.AfterCollect(func(err error) {
+			exporter.Flush(context.Background())
+		})
+		// Metrics not exported yet are sent on shutdown
+		defer exporter.Shutdown(context.Background())
+	}
+	if sinks := startSinks(config); len(sinks) > 0 {
+		sendAfterCollect(runner, server.Registry, sinks)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go runner.RunContext(ctx)
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	err := server.ListenAndServe()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Panic("Cannot serve metrics via HTTP")
+	}
+}
+
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
@@ -74,18 +214,31 @@ func main() {
 		}).Panic("Cannot load config file")
 	}
 
-	bitbucketBaseURL := getEnvOrPanic("BASE_URL")
-	username := getEnvOrPanic("USERNAME")
-	password := getEnvOrPanic("PASSWORD")
-	apiPageSize := config.Bitbucket.ApiPageSize
-	bitbucketRequestManager := bitbucket.Init(bitbucketBaseURL, username, password, apiPageSize)
-
-	hostname := config.Bitbucket.Metrics.Hostname
-	metricsPortNumber := uint16(config.Bitbucket.Metrics.Port)
-	metricsPath := config.Bitbucket.Metrics.Path
-	metrics.ListenAndServe(hostname, metricsPortNumber, metricsPath, func(metricsToBeCollected *metrics.Metrics) {
-		bitbucket.NewRunner(config, bitbucketRequestManager, metricsToBeCollected)
-	})
+	// Without a command the metrics are served via HTTP
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		serve(config)
+	case "collect":
+		collect(config, args)
+	case "export":
+		export(config, args)
+	case "push":
+		pushMetrics(config, args)
+	case "otlp":
+		exportOTLP(config, args)
+	case "send":
+		send(config, args)
+	case "backfill":
+		backfill(config, args)
+	case "reveal":
+		reveal(config, args)
+	default:
+		log.Fatalf("Unknown command '%s', valid ones are 'serve', 'collect', 'push', 'otlp', 'send', 'backfill', 'export' & 'reveal'", command)
+	}
 
 	log.Info("Application stopped")
 }
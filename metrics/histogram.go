@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SnapshotHistogramVec is a histogram whose series are fully replaced on each
+// collection, instead of accumulating observations forever like prometheus.HistogramVec.
+type SnapshotHistogramVec struct {
+	desc    *prometheus.Desc
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]snapshotHistogram
+}
+
+type snapshotHistogram struct {
+	labelValues  []string
+	count        uint64
+	sum          float64
+	bucketCounts map[float64]uint64
+}
+
+func NewSnapshotHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *SnapshotHistogramVec {
+	buckets := opts.Buckets
+	if buckets == nil {
+		buckets = prometheus.DefBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &SnapshotHistogramVec{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+			opts.Help,
+			labelNames,
+			opts.ConstLabels,
+		),
+		buckets: buckets,
+		series:  map[string]snapshotHistogram{},
+	}
+}
+
+func (vec *SnapshotHistogramVec) Set(labelValues []string, observations []float64) {
+	histogram := snapshotHistogram{
+		labelValues:  append([]string{}, labelValues...),
+		count:        uint64(len(observations)),
+		bucketCounts: map[float64]uint64{},
+	}
+	for _, observation := range observations {
+		histogram.sum += observation
+		for _, bucket := range vec.buckets {
+			if observation <= bucket {
+				histogram.bucketCounts[bucket] += 1
+			}
+		}
+	}
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	vec.series[strings.Join(labelValues, "\xff")] = histogram
+}
+
+func (vec *SnapshotHistogramVec) Reset() {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	vec.series = map[string]snapshotHistogram{}
+}
+
+func (vec *SnapshotHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vec.desc
+}
+
+func (vec *SnapshotHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	for _, histogram := range vec.series {
+		ch <- prometheus.MustNewConstHistogram(
+			vec.desc,
+			histogram.count,
+			histogram.sum,
+			histogram.bucketCounts,
+			histogram.labelValues...,
+		)
+	}
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshotHistogramVecReplacesObservations(t *testing.T) {
+	vec := NewSnapshotHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "test_histogram",
+			Help:    "Test histogram",
+			Buckets: []float64{10, 1},
+		},
+		[]string{"repo"},
+	)
+	vec.Set([]string{"repo1"}, []float64{100, 200})
+	vec.Set([]string{"repo1"}, []float64{0.5, 5, 50})
+
+	expected := `
+# HELP test_histogram Test histogram
+# TYPE test_histogram histogram
+test_histogram_bucket{repo="repo1",le="1"} 1
+test_histogram_bucket{repo="repo1",le="10"} 2
+test_histogram_bucket{repo="repo1",le="+Inf"} 3
+test_histogram_sum{repo="repo1"} 55.5
+test_histogram_count{repo="repo1"} 3
+`
+	if err := testutil.CollectAndCompare(vec, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected histogram: %v", err)
+	}
+
+	vec.Reset()
+	if count := testutil.CollectAndCount(vec); count != 0 {
+		t.Errorf("Unexpected %v series after reset, expected 0", count)
+	}
+}
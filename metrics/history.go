@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"cmp"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// History keeps gathered snapshots as timestamped samples, written at the end as a single OpenMetrics exposition
+// because every family must be contiguous there (e.g. for promtool tsdb create-blocks-from openmetrics)
+type History struct {
+	families map[string]*dto.MetricFamily
+	names    []string
+}
+
+func NewHistory() *History {
+	return &History{
+		families: map[string]*dto.MetricFamily{},
+	}
+}
+
+func (history *History) Add(gatherer prometheus.Gatherer, timestamp time.Time) error {
+	metricFamilies, err := gatherer.Gather()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot gather metrics")
+		return err
+	}
+	for _, metricFamily := range metricFamilies {
+		family, ok := history.families[metricFamily.GetName()]
+		if !ok {
+			family = proto.Clone(metricFamily).(*dto.MetricFamily)
+			family.Metric = nil
+			history.families[metricFamily.GetName()] = family
+			history.names = append(history.names, metricFamily.GetName())
+		}
+		for _, metric := range metricFamily.GetMetric() {
+			metric.TimestampMs = proto.Int64(timestamp.UnixMilli())
+			family.Metric = append(family.Metric, metric)
+		}
+	}
+	return nil
+}
+
+func labelsKey(metric *dto.Metric) string {
+	var key strings.Builder
+	for _, label := range metric.GetLabel() {
+		key.WriteString(label.GetName() + "\x00" + label.GetValue() + "\x00")
+	}
+	return key.String()
+}
+
+func (history *History) WriteOpenMetrics(writer io.Writer) error {
+	for _, name := range slices.Sorted(slices.Values(history.names)) {
+		family := history.families[name]
+		// Points of the same series must be contiguous & in time order
+		slices.SortStableFunc(family.Metric, func(a, b *dto.Metric) int {
+			return cmp.Or(cmp.Compare(labelsKey(a), labelsKey(b)), cmp.Compare(a.GetTimestampMs(), b.GetTimestampMs()))
+		})
+		_, err := expfmt.MetricFamilyToOpenMetrics(writer, family)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"metric": name,
+				"error":  err,
+			}).Error("Cannot write metrics in OpenMetrics format")
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(writer)
+	return err
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type InfluxDBOptions struct {
+	URL     string
+	Token   string
+	Timeout time.Duration
+	TLS     TLSOptions
+}
+
+type InfluxDBSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxDBTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func NewInfluxDBSink(options InfluxDBOptions) (*InfluxDBSink, error) {
+	tlsConfig, err := tlsConfig(options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &InfluxDBSink{
+		url:   options.URL,
+		token: options.Token,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   options.Timeout,
+		},
+	}, nil
+}
+
+func (sink *InfluxDBSink) Name() string {
+	return "influxdb"
+}
+
+// encodeLineProtocol writes every sample as a point of its metric measurement, labels as tags & the value as field
+func encodeLineProtocol(samples []Sample, timestamp time.Time) []byte {
+	var lines bytes.Buffer
+	for _, sample := range samples {
+		// Line protocol has no way to tell NaN nor infinite values
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		lines.WriteString(influxDBMeasurementEscaper.Replace(sample.Name))
+		for _, label := range sample.Labels {
+			// Empty tag values aren't allowed either
+			if label.Value == "" {
+				continue
+			}
+			lines.WriteString(",")
+			lines.WriteString(influxDBTagEscaper.Replace(label.Name))
+			lines.WriteString("=")
+			lines.WriteString(influxDBTagEscaper.Replace(label.Value))
+		}
+		lines.WriteString(" value=")
+		lines.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		lines.WriteString(" ")
+		lines.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+		lines.WriteString("\n")
+	}
+	return lines.Bytes()
+}
+
+func (sink *InfluxDBSink) Send(ctx context.Context, samples []Sample, timestamp time.Time) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.url, bytes.NewReader(encodeLineProtocol(samples, timestamp)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if sink.token != "" {
+		request.Header.Set("Authorization", "Token "+sink.token)
+	}
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("InfluxDB answered %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	}
+	io.Copy(io.Discard, response.Body)
+	return nil
+}
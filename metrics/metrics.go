@@ -1,93 +1,527 @@
 package metrics
 
 import (
-	"fmt"
-	"net/http"
+	"io"
+	"slices"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
+// Lead times from an hour to a month
+var LEAD_TIME_BUCKETS = []float64{3600, 4 * 3600, 24 * 3600, 2 * 24 * 3600, 7 * 24 * 3600, 14 * 24 * 3600, 30 * 24 * 3600}
+
 type Metrics struct {
-	ProjectsGauge         prometheus.Gauge
-	RepositoriesGauge     prometheus.Gauge
-	PRsByAuthorGauge      *prometheus.GaugeVec
-	PRsByReviewerGauge    *prometheus.GaugeVec
-	BranchesByAuthorGauge *prometheus.GaugeVec
-	TagsByAuthorGauge     *prometheus.GaugeVec
-	CollectTimeGauge      prometheus.Gauge
+	ProjectsGauge               prometheus.Gauge
+	RepositoriesGauge           prometheus.Gauge
+	PRsByAuthorGauge            *prometheus.GaugeVec
+	PRsByReviewerGauge          *prometheus.GaugeVec
+	ReviewPairsGauge            *prometheus.GaugeVec
+	ReviewQueueGauge            *prometheus.GaugeVec
+	ReviewGiniGauge             *prometheus.GaugeVec
+	OpenPRsGauge                *prometheus.GaugeVec
+	PRsAwaitingReviewGauge      *prometheus.GaugeVec
+	BranchesByAuthorGauge       *prometheus.GaugeVec
+	TagsByAuthorGauge           *prometheus.GaugeVec
+	PRsByTeamGauge              *prometheus.GaugeVec
+	PRsByReviewerTeamGauge      *prometheus.GaugeVec
+	BranchesByTeamGauge         *prometheus.GaugeVec
+	TagsByTeamGauge             *prometheus.GaugeVec
+	CommitsByAuthorGauge        *prometheus.GaugeVec
+	BusFactorGauge              *prometheus.GaugeVec
+	TopContributorShareGauge    *prometheus.GaugeVec
+	PRThroughputGauge           *prometheus.GaugeVec
+	PRThroughputByAuthorGauge   *prometheus.GaugeVec
+	PRLeadTimeHistogram         *SnapshotHistogramVec
+	PRReleaseLeadTimeHistogram  *SnapshotHistogramVec
+	DeploymentsGauge            *prometheus.GaugeVec
+	PRSizeLinesHistogram        *SnapshotHistogramVec
+	PRsBySizeGauge              *prometheus.GaugeVec
+	PRLinesAddedByAuthorGauge   *prometheus.GaugeVec
+	PRLinesRemovedByAuthorGauge *prometheus.GaugeVec
+	PRFilesChangedByAuthorGauge *prometheus.GaugeVec
+	PRCommentsHistogram         *SnapshotHistogramVec
+	PROpenTasksHistogram        *SnapshotHistogramVec
+	PRResolvedTasksHistogram    *SnapshotHistogramVec
+	PRParticipantsHistogram     *SnapshotHistogramVec
+	PRCommentsByAuthorGauge     *prometheus.GaugeVec
+	PRBuildsGauge               *prometheus.GaugeVec
+	DefaultBranchBuildsGauge    *prometheus.GaugeVec
+	FoldedSeriesGauge           *prometheus.GaugeVec
+	DecodeFailuresGauge         prometheus.Gauge
+	CollectErrorsGauge          prometheus.Gauge
+	CollectTimeGauge            prometheus.Gauge
+	// Labels single person series have after the person one, like display_name or team
+	PersonLabels []string
+	disabled     []string
+}
+
+type Options struct {
+	Prefix      string
+	ConstLabels map[string]string
+	Disabled    []string
+	// Labels added to single person series, valued by the collector
+	PersonLabels []string
+	// Go runtime & process collectors are only registered by servers on demand
+	RuntimeCollectors bool
 }
 
-func ListenAndServe(hostname string, port uint16, path string, takeMetrics func(metrics *Metrics)) {
-	metrics := Metrics{
+func NewMetrics() *Metrics {
+	return NewMetricsWithOptions(Options{
+		Prefix: "bitbucket",
+	})
+}
+
+func NewMetricsWithOptions(options Options) *Metrics {
+	personLabels := func(labels ...string) []string {
+		return append(labels, options.PersonLabels...)
+	}
+	return &Metrics{
 		ProjectsGauge: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_projects",
-				Help: "Number of Bitbucket projects being monitored",
+				Namespace:   options.Prefix,
+				Name:        "projects",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket projects being monitored",
 			},
 		),
 		RepositoriesGauge: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_repositories",
-				Help: "Number of Bitbucket repositories being monitored",
+				Namespace:   options.Prefix,
+				Name:        "repositories",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket repositories being monitored",
 			},
 		),
 		PRsByAuthorGauge: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_prs_by_author",
-				Help: "Number of Bitbucket PRs by author being monitored",
+				Namespace:   options.Prefix,
+				Name:        "prs_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs by author being monitored",
 			},
-			[]string{"project", "repo", "author"},
+			personLabels("project", "repo", "author"),
 		),
 		PRsByReviewerGauge: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_prs_by_reviewer",
-				Help: "Number of Bitbucket PRs by reviewer being monitored",
+				Namespace:   options.Prefix,
+				Name:        "prs_by_reviewer",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs by reviewer being monitored",
+			},
+			personLabels("project", "repo", "reviewer"),
+		),
+		ReviewPairsGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "review_pairs",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs by author having reviewer",
 			},
-			[]string{"project", "repo", "reviewer"},
+			[]string{"project", "author", "reviewer"},
+		),
+		ReviewQueueGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "review_queue",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of open Bitbucket PRs not approved yet by reviewer",
+			},
+			personLabels("project", "repo", "reviewer"),
+		),
+		ReviewGiniGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "review_gini",
+				ConstLabels: options.ConstLabels,
+				Help:        "Gini coefficient of Bitbucket PR reviews among PR authors & reviewers, the higher the more concentrated",
+			},
+			[]string{"project", "repo"},
+		),
+		OpenPRsGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "open_prs",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket open PRs",
+			},
+			[]string{"project", "repo"},
+		),
+		PRsAwaitingReviewGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "prs_awaiting_review",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket open PRs without any reviewer approval",
+			},
+			[]string{"project", "repo"},
 		),
 		BranchesByAuthorGauge: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_branches_by_author",
-				Help: "Number of Bitbucket branches by author being monitored",
+				Namespace:   options.Prefix,
+				Name:        "branches_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket branches by author being monitored",
 			},
-			[]string{"project", "repo", "author"},
+			personLabels("project", "repo", "author"),
 		),
 		TagsByAuthorGauge: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_tags_by_author",
-				Help: "Number of Bitbucket tags by author being monitored",
+				Namespace:   options.Prefix,
+				Name:        "tags_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket tags by author being monitored",
+			},
+			personLabels("project", "repo", "author"),
+		),
+		PRsByTeamGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "prs_by_team",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs by author team being monitored",
+			},
+			[]string{"project", "repo", "team"},
+		),
+		PRsByReviewerTeamGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "prs_by_reviewer_team",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs by reviewer team being monitored",
+			},
+			[]string{"project", "repo", "team"},
+		),
+		BranchesByTeamGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "branches_by_team",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket branches by author team being monitored",
+			},
+			[]string{"project", "repo", "team"},
+		),
+		TagsByTeamGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "tags_by_team",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket tags by author team being monitored",
+			},
+			[]string{"project", "repo", "team"},
+		),
+		CommitsByAuthorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "commits_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket commits on default branch by author within a time window",
+			},
+			personLabels("project", "repo", "author", "window"),
+		),
+		BusFactorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "bus_factor",
+				ConstLabels: options.ConstLabels,
+				Help:        "Minimum number of authors covering a share of Bitbucket commits on default branch within the ownership window",
+			},
+			[]string{"project", "repo"},
+		),
+		TopContributorShareGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "top_contributor_share",
+				ConstLabels: options.ConstLabels,
+				Help:        "Share of Bitbucket commits on default branch by their top author within the ownership window",
+			},
+			[]string{"project", "repo"},
+		),
+		PRThroughputGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_throughput",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs opened, merged or declined within a time window",
+			},
+			[]string{"project", "repo", "event", "window"},
+		),
+		PRThroughputByAuthorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_throughput_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs opened, merged or declined by author within a time window",
+			},
+			personLabels("project", "repo", "author", "event", "window"),
+		),
+		PRLeadTimeHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_lead_time_seconds",
+				ConstLabels: options.ConstLabels,
+				Help:        "Time from the first commit of Bitbucket PRs to their merge into the default branch",
+				Buckets:     LEAD_TIME_BUCKETS,
+			},
+			[]string{"project", "repo"},
+		),
+		PRReleaseLeadTimeHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_release_lead_time_seconds",
+				ConstLabels: options.ConstLabels,
+				Help:        "Time from the merge of Bitbucket PRs into the default branch to the first release tag containing it",
+				Buckets:     LEAD_TIME_BUCKETS,
+			},
+			[]string{"project", "repo"},
+		),
+		DeploymentsGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "deployments",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket release tags created within a time window",
+			},
+			[]string{"project", "repo", "window"},
+		),
+		PRSizeLinesHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_size_lines",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket PRs size in lines added plus removed",
+				Buckets:     []float64{10, 50, 100, 250, 500, 1000, 2500, 5000},
+			},
+			[]string{"project", "repo"},
+		),
+		PRsBySizeGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "prs_by_size",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PRs by size (XS, S, M, L, XL...)",
+			},
+			[]string{"project", "repo", "size"},
+		),
+		PRLinesAddedByAuthorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_lines_added_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of lines added on Bitbucket PRs by author",
+			},
+			personLabels("project", "repo", "author"),
+		),
+		PRLinesRemovedByAuthorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_lines_removed_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of lines removed on Bitbucket PRs by author",
+			},
+			personLabels("project", "repo", "author"),
+		),
+		PRFilesChangedByAuthorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_files_changed_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of files changed on Bitbucket PRs by author",
+			},
+			personLabels("project", "repo", "author"),
+		),
+		PRCommentsHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_comments",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket PRs number of comments",
+				Buckets:     []float64{0, 1, 2, 5, 10, 20, 50, 100},
+			},
+			[]string{"project", "repo"},
+		),
+		PROpenTasksHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_open_tasks",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket PRs number of open tasks",
+				Buckets:     []float64{0, 1, 2, 5, 10, 20},
+			},
+			[]string{"project", "repo"},
+		),
+		PRResolvedTasksHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_resolved_tasks",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket PRs number of resolved tasks",
+				Buckets:     []float64{0, 1, 2, 5, 10, 20},
+			},
+			[]string{"project", "repo"},
+		),
+		PRParticipantsHistogram: NewSnapshotHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_participants",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket PRs number of participants (author, reviewers & rest of participants)",
+				Buckets:     []float64{1, 2, 3, 5, 8, 13},
+			},
+			[]string{"project", "repo"},
+		),
+		PRCommentsByAuthorGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_comments_by_author",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket PR comments by author",
+			},
+			personLabels("project", "repo", "author"),
+		),
+		PRBuildsGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "pr_builds",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket open PRs whose head commit has a build by key & state",
+			},
+			[]string{"project", "repo", "key", "state"},
+		),
+		DefaultBranchBuildsGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "default_branch_builds",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket builds by key & state of the default branch latest commit",
+			},
+			[]string{"project", "repo", "key", "state"},
+		),
+		FoldedSeriesGauge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "folded_series",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of series folded into other person series on last publish by metric because of cardinality limits",
+			},
+			[]string{"metric"},
+		),
+		DecodeFailuresGauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "decode_failures",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket records skipped on last metrics collection because they could not be decoded",
+			},
+		),
+		CollectErrorsGauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace:   options.Prefix,
+				Name:        "collect_errors",
+				ConstLabels: options.ConstLabels,
+				Help:        "Number of Bitbucket requests failed on last metrics collection",
 			},
-			[]string{"project", "repo", "author"},
 		),
 		CollectTimeGauge: prometheus.NewGauge(
 			prometheus.GaugeOpts{
-				Name: "bitbucket_collect_time",
-				Help: "Bitbucket metrics collect time in milliseconds",
+				Namespace:   options.Prefix,
+				Name:        "collect_time",
+				ConstLabels: options.ConstLabels,
+				Help:        "Bitbucket metrics collect time in milliseconds",
 			},
 		),
+		PersonLabels: options.PersonLabels,
+		disabled:     options.Disabled,
 	}
-	takeMetrics(&metrics)
+}
 
-	prometheus.MustRegister(
-		metrics.ProjectsGauge,
-		metrics.RepositoriesGauge,
-		metrics.PRsByAuthorGauge,
-		metrics.PRsByReviewerGauge,
-		metrics.BranchesByAuthorGauge,
-		metrics.TagsByAuthorGauge,
-		metrics.CollectTimeGauge,
-	)
+type family struct {
+	name      string
+	collector prometheus.Collector
+}
 
-	http.Handle(path, promhttp.Handler())
+func (metrics *Metrics) families() []family {
+	return []family{
+		{"projects", metrics.ProjectsGauge},
+		{"repositories", metrics.RepositoriesGauge},
+		{"prs_by_author", metrics.PRsByAuthorGauge},
+		{"prs_by_reviewer", metrics.PRsByReviewerGauge},
+		{"review_pairs", metrics.ReviewPairsGauge},
+		{"review_queue", metrics.ReviewQueueGauge},
+		{"review_gini", metrics.ReviewGiniGauge},
+		{"open_prs", metrics.OpenPRsGauge},
+		{"prs_awaiting_review", metrics.PRsAwaitingReviewGauge},
+		{"branches_by_author", metrics.BranchesByAuthorGauge},
+		{"tags_by_author", metrics.TagsByAuthorGauge},
+		{"prs_by_team", metrics.PRsByTeamGauge},
+		{"prs_by_reviewer_team", metrics.PRsByReviewerTeamGauge},
+		{"branches_by_team", metrics.BranchesByTeamGauge},
+		{"tags_by_team", metrics.TagsByTeamGauge},
+		{"commits_by_author", metrics.CommitsByAuthorGauge},
+		{"bus_factor", metrics.BusFactorGauge},
+		{"top_contributor_share", metrics.TopContributorShareGauge},
+		{"pr_throughput", metrics.PRThroughputGauge},
+		{"pr_throughput_by_author", metrics.PRThroughputByAuthorGauge},
+		{"pr_lead_time_seconds", metrics.PRLeadTimeHistogram},
+		{"pr_release_lead_time_seconds", metrics.PRReleaseLeadTimeHistogram},
+		{"deployments", metrics.DeploymentsGauge},
+		{"pr_size_lines", metrics.PRSizeLinesHistogram},
+		{"prs_by_size", metrics.PRsBySizeGauge},
+		{"pr_lines_added_by_author", metrics.PRLinesAddedByAuthorGauge},
+		{"pr_lines_removed_by_author", metrics.PRLinesRemovedByAuthorGauge},
+		{"pr_files_changed_by_author", metrics.PRFilesChangedByAuthorGauge},
+		{"pr_comments", metrics.PRCommentsHistogram},
+		{"pr_open_tasks", metrics.PROpenTasksHistogram},
+		{"pr_resolved_tasks", metrics.PRResolvedTasksHistogram},
+		{"pr_participants", metrics.PRParticipantsHistogram},
+		{"pr_comments_by_author", metrics.PRCommentsByAuthorGauge},
+		{"pr_builds", metrics.PRBuildsGauge},
+		{"default_branch_builds", metrics.DefaultBranchBuildsGauge},
+		{"folded_series", metrics.FoldedSeriesGauge},
+		{"decode_failures", metrics.DecodeFailuresGauge},
+		{"collect_errors", metrics.CollectErrorsGauge},
+		{"collect_time", metrics.CollectTimeGauge},
+	}
+}
 
-	log.WithFields(log.Fields{
-		"hostname": hostname,
-		"port":     port,
-		"path":     path,
-		"url":      fmt.Sprintf("http://%v:%v%v", hostname, port, path),
-	}).Info("Serving metrics via HTTP")
-	http.ListenAndServe(":"+fmt.Sprint(port), nil)
+func (metrics *Metrics) Collectors() []prometheus.Collector {
+	families := metrics.families()
+	for _, name := range metrics.disabled {
+		if !slices.ContainsFunc(families, func(family family) bool { return family.name == name }) {
+			log.WithFields(log.Fields{
+				"metric": name,
+			}).Warn("Unknown metric to disable")
+		}
+	}
+	var collectors []prometheus.Collector
+	for _, family := range families {
+		// Disabled metrics are not even registered, so they are never exposed
+		if !slices.Contains(metrics.disabled, family.name) {
+			collectors = append(collectors, family.collector)
+		}
+	}
+	return collectors
+}
+
+func WriteText(gatherer prometheus.Gatherer, writer io.Writer) error {
+	metricFamilies, err := gatherer.Gather()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot gather metrics")
+		return err
+	}
+	for _, metricFamily := range metricFamilies {
+		_, err := expfmt.MetricFamilyToText(writer, metricFamily)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"metric": metricFamily.GetName(),
+				"error":  err,
+			}).Error("Cannot write metric as text")
+			return err
+		}
+	}
+	return nil
 }
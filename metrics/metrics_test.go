@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsWithOptions(t *testing.T) {
+	metrics := NewMetricsWithOptions(Options{
+		Prefix:      "scm",
+		ConstLabels: map[string]string{"environment": "test"},
+		Disabled:    []string{"prs_by_reviewer", "collect_time"},
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.Collectors()...)
+	metrics.ProjectsGauge.Set(2)
+	metrics.PRsByReviewerGauge.WithLabelValues("P1", "repo-1", "alice").Set(1)
+
+	expected := `
+# HELP scm_projects Number of Bitbucket projects being monitored
+# TYPE scm_projects gauge
+scm_projects{environment="test"} 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "scm_projects"); err != nil {
+		t.Error(err)
+	}
+	if count, err := testutil.GatherAndCount(registry, "scm_prs_by_reviewer", "scm_collect_time"); err != nil || count != 0 {
+		t.Errorf("Unexpected %v disabled series (error %v), expected none", count, err)
+	}
+	if len(metrics.Collectors()) != len(NewMetrics().Collectors())-2 {
+		t.Errorf("Unexpected %v collectors, expected 2 less than all of them", len(metrics.Collectors()))
+	}
+}
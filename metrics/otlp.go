@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	otelprometheus "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+var OTLP_PROTOCOLS = []string{"http", "grpc"}
+
+const OTLP_HTTP_PATH = "/v1/metrics"
+
+type OTLPOptions struct {
+	Protocol           string
+	Endpoint           string
+	Headers            map[string]string
+	Interval           time.Duration
+	ResourceAttributes map[string]string
+}
+
+type OTLPExporter struct {
+	endpoint string
+	provider *sdkmetric.MeterProvider
+}
+
+func newOTLPExporter(ctx context.Context, options OTLPOptions) (sdkmetric.Exporter, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch options.Protocol {
+	case "http":
+		// Without any path the OTLP default one is used
+		if endpoint.Path == "" || endpoint.Path == "/" {
+			endpoint.Path = OTLP_HTTP_PATH
+		}
+		return otlpmetrichttp.New(ctx,
+			otlpmetrichttp.WithEndpointURL(endpoint.String()),
+			otlpmetrichttp.WithHeaders(options.Headers),
+		)
+	case "grpc":
+		return otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithEndpointURL(endpoint.String()),
+			otlpmetricgrpc.WithHeaders(options.Headers),
+		)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol '%s', valid ones are %v", options.Protocol, OTLP_PROTOCOLS)
+	}
+}
+
+// NewOTLPExporter periodically exports every series gathered from the gatherer via OTLP until shut down
+func NewOTLPExporter(ctx context.Context, options OTLPOptions, gatherer prometheus.Gatherer) (*OTLPExporter, error) {
+	exporter, err := newOTLPExporter(ctx, options)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"protocol": options.Protocol,
+			"endpoint": options.Endpoint,
+			"error":    err,
+		}).Error("Cannot create OTLP exporter")
+		return nil, err
+	}
+
+	var attributes []attribute.KeyValue
+	for _, key := range slices.Sorted(maps.Keys(options.ResourceAttributes)) {
+		attributes = append(attributes, attribute.String(key, options.ResourceAttributes[key]))
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(options.Interval),
+		sdkmetric.WithProducer(otelprometheus.NewMetricProducer(otelprometheus.WithGatherer(gatherer))),
+	)
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(attributes...)),
+	)
+	log.WithFields(log.Fields{
+		"protocol": options.Protocol,
+		"endpoint": options.Endpoint,
+		"interval": options.Interval,
+	}).Info("Exporting metrics via OTLP")
+	return &OTLPExporter{
+		endpoint: options.Endpoint,
+		provider: provider,
+	}, nil
+}
+
+func (exporter *OTLPExporter) Flush(ctx context.Context) error {
+	err := exporter.provider.ForceFlush(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"endpoint": exporter.endpoint,
+			"error":    err,
+		}).Error("Cannot export metrics via OTLP")
+	}
+	return err
+}
+
+// Shutdown exports pending metrics before stopping
+func (exporter *OTLPExporter) Shutdown(ctx context.Context) error {
+	err := exporter.provider.Shutdown(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"endpoint": exporter.endpoint,
+			"error":    err,
+		}).Error("Cannot shut OTLP exporter down")
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTLPExporterExportsOverHTTP(t *testing.T) {
+	var mutex sync.Mutex
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != OTLP_HTTP_PATH {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, OTLP_HTTP_PATH)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Invalid authorization header '%v'", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		bodies = append(bodies, body)
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	metrics := NewMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.Collectors()...)
+	metrics.ProjectsGauge.Set(3)
+	exporter, err := NewOTLPExporter(context.Background(), OTLPOptions{
+		Protocol:           "http",
+		Endpoint:           ts.URL,
+		Headers:            map[string]string{"Authorization": "Bearer token"},
+		Interval:           time.Hour,
+		ResourceAttributes: map[string]string{"bitbucket.url": "https://bitbucket.example.com"},
+	}, registry)
+	if err != nil {
+		t.Fatalf("Unexpected exporter error %v", err)
+	}
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected shutdown error %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("Unexpected %v exports, expected 1", len(bodies))
+	}
+	// Protobuf keeps strings as they are
+	for _, expected := range []string{"bitbucket_projects", "bitbucket.url", "https://bitbucket.example.com"} {
+		if !bytes.Contains(bodies[0], []byte(expected)) {
+			t.Errorf("Exported metrics lack '%v'", expected)
+		}
+	}
+}
+
+func TestOTLPExporterWithUnknownProtocol(t *testing.T) {
+	_, err := NewOTLPExporter(context.Background(), OTLPOptions{
+		Protocol: "udp",
+		Endpoint: "http://localhost:4318",
+		Interval: time.Minute,
+	}, prometheus.NewRegistry())
+	if err == nil {
+		t.Error("Expected an error with an unknown protocol")
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+type TLSOptions struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+type PushOptions struct {
+	URL      string
+	Job      string
+	Instance string
+	Username string
+	Password string
+	TLS      TLSOptions
+}
+
+type Pusher struct {
+	url      string
+	job      string
+	instance string
+	pusher   *push.Pusher
+}
+
+func tlsConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		ca, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no PEM certificate found in CA file '%s'", options.CAFile)
+		}
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+func NewPusher(options PushOptions, gatherer prometheus.Gatherer) (*Pusher, error) {
+	tlsConfig, err := tlsConfig(options.TLS)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   options.URL,
+			"error": err,
+		}).Error("Cannot configure Pushgateway TLS")
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	pusher := push.New(options.URL, options.Job).
+		Gatherer(gatherer).
+		Grouping("instance", options.Instance).
+		Client(&http.Client{Transport: transport})
+	if options.Username != "" {
+		pusher = pusher.BasicAuth(options.Username, options.Password)
+	}
+	return &Pusher{
+		url:      options.URL,
+		job:      options.Job,
+		instance: options.Instance,
+		pusher:   pusher,
+	}, nil
+}
+
+func (pusher *Pusher) Push() error {
+	// Every push replaces the whole group, so the Pushgateway keeps just the last snapshot
+	err := pusher.pusher.Push()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":      pusher.url,
+			"job":      pusher.job,
+			"instance": pusher.instance,
+			"error":    err,
+		}).Error("Cannot push metrics to Pushgateway")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"url":      pusher.url,
+		"job":      pusher.job,
+		"instance": pusher.instance,
+	}).Info("Metrics pushed to Pushgateway")
+	return nil
+}
+
+func (pusher *Pusher) Delete() error {
+	err := pusher.pusher.Delete()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":      pusher.url,
+			"job":      pusher.job,
+			"instance": pusher.instance,
+			"error":    err,
+		}).Error("Cannot delete metrics from Pushgateway")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"url":      pusher.url,
+		"job":      pusher.job,
+		"instance": pusher.instance,
+	}).Info("Metrics deleted from Pushgateway")
+	return nil
+}
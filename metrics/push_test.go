@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPusherPushesAndDeletesGroup(t *testing.T) {
+	var methods []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		expectedPath := "/metrics/job/bitbucket-metrics/instance/host-1"
+		if r.URL.Path != expectedPath {
+			t.Errorf("Invalid path '%v', expected '%v'", r.URL.Path, expectedPath)
+		}
+		if username, password, ok := r.BasicAuth(); !ok || username != "username" || password != "password" {
+			t.Errorf("Invalid basic auth '%v:%v'", username, password)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodPut && !strings.Contains(string(body), "bitbucket_projects") {
+			t.Errorf("Pushed body lacks metrics: %q", body)
+		}
+		// Like the Pushgateway, deletions are just accepted
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// The test server certificate is the only trusted CA
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatalf("Cannot write CA file %v", err)
+	}
+
+	metrics := NewMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.Collectors()...)
+	metrics.ProjectsGauge.Set(1)
+	pusher, err := NewPusher(PushOptions{
+		URL:      ts.URL,
+		Job:      "bitbucket-metrics",
+		Instance: "host-1",
+		Username: "username",
+		Password: "password",
+		TLS:      TLSOptions{CAFile: caFile},
+	}, registry)
+	if err != nil {
+		t.Fatalf("Unexpected pusher error %v", err)
+	}
+	if err := pusher.Push(); err != nil {
+		t.Fatalf("Unexpected push error %v", err)
+	}
+	if err := pusher.Delete(); err != nil {
+		t.Fatalf("Unexpected delete error %v", err)
+	}
+	if len(methods) != 2 || methods[0] != http.MethodPut || methods[1] != http.MethodDelete {
+		t.Errorf("Unexpected methods %v, expected PUT & DELETE", methods)
+	}
+}
+
+func TestPusherWithInvalidCAFile(t *testing.T) {
+	_, err := NewPusher(PushOptions{
+		URL: "https://localhost:9091",
+		Job: "bitbucket-metrics",
+		TLS: TLSOptions{CAFile: "notexistingfile.pem"},
+	}, prometheus.NewRegistry())
+	if err == nil {
+		t.Error("Expected an error with a not existing CA file")
+	}
+}
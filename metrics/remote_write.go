@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const REMOTE_WRITE_VERSION = "0.1.0"
+
+type RemoteWriteOptions struct {
+	URL         string
+	Username    string
+	Password    string
+	BearerToken string
+	Retries     int
+	Backoff     time.Duration
+	Timeout     time.Duration
+	TLS         TLSOptions
+}
+
+type RemoteWriter struct {
+	options RemoteWriteOptions
+	client  *http.Client
+}
+
+type remoteWriteError struct {
+	status    int
+	body      string
+	retryable bool
+}
+
+func (err *remoteWriteError) Error() string {
+	return fmt.Sprintf("remote write answered %d: %s", err.status, err.body)
+}
+
+func NewRemoteWriter(options RemoteWriteOptions) (*RemoteWriter, error) {
+	tlsConfig, err := tlsConfig(options.TLS)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   options.URL,
+			"error": err,
+		}).Error("Cannot configure remote write TLS")
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	log.WithFields(log.Fields{
+		"url": options.URL,
+	}).Info("Writing metrics via Prometheus remote write")
+	return &RemoteWriter{
+		options: options,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   options.Timeout,
+		},
+	}, nil
+}
+
+// encodeWriteRequest encodes the samples as a remote write WriteRequest protobuf message, all sharing the timestamp
+func encodeWriteRequest(samples []Sample, timestamp time.Time) []byte {
+	var request []byte
+	for _, entry := range samples {
+		labels := append([]Label{{Name: "__name__", Value: entry.Name}}, entry.Labels...)
+		// Remote write receivers expect labels sorted by name
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+		var timeSeries []byte
+		for _, label := range labels {
+			var encodedLabel []byte
+			encodedLabel = protowire.AppendTag(encodedLabel, 1, protowire.BytesType)
+			encodedLabel = protowire.AppendString(encodedLabel, label.Name)
+			encodedLabel = protowire.AppendTag(encodedLabel, 2, protowire.BytesType)
+			encodedLabel = protowire.AppendString(encodedLabel, label.Value)
+			timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, encodedLabel)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(entry.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp.UnixMilli()))
+		timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+		timeSeries = protowire.AppendBytes(timeSeries, sample)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, timeSeries)
+	}
+	return request
+}
+
+func (writer *RemoteWriter) send(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, writer.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("User-Agent", "bitbucket-metrics")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", REMOTE_WRITE_VERSION)
+	if writer.options.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+writer.options.BearerToken)
+	} else if writer.options.Username != "" {
+		request.SetBasicAuth(writer.options.Username, writer.options.Password)
+	}
+	response, err := writer.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	return &remoteWriteError{
+		status: response.StatusCode,
+		body:   string(bytes.TrimSpace(message)),
+		// Like Prometheus, only server errors & throttling are worth retrying
+		retryable: response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+func (writer *RemoteWriter) Name() string {
+	return "remote_write"
+}
+
+// Send writes the samples with the given timestamp, retrying with exponential backoff on failures
+func (writer *RemoteWriter) Send(ctx context.Context, samples []Sample, timestamp time.Time) error {
+	body := snappy.Encode(nil, encodeWriteRequest(samples, timestamp))
+	backoff := writer.options.Backoff
+	for attempt := 0; ; attempt++ {
+		err := writer.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+		remoteErr, ok := err.(*remoteWriteError)
+		if (ok && !remoteErr.retryable) || attempt >= writer.options.Retries || ctx.Err() != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"url":     writer.options.URL,
+			"attempt": attempt + 1,
+			"backoff": backoff,
+			"error":   err,
+		}).Warn("Remote write failed, retrying...")
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
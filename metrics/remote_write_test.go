@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type decodedSample struct {
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest maps the samples of a WriteRequest by series name
+func decodeWriteRequest(t *testing.T, body []byte) map[string][]decodedSample {
+	t.Helper()
+	fields := func(message []byte, each func(number protowire.Number, kind protowire.Type, value []byte, raw uint64)) {
+		for len(message) > 0 {
+			number, kind, n := protowire.ConsumeTag(message)
+			if n < 0 {
+				t.Fatalf("Invalid protobuf tag")
+			}
+			message = message[n:]
+			switch kind {
+			case protowire.BytesType:
+				value, n := protowire.ConsumeBytes(message)
+				each(number, kind, value, 0)
+				message = message[n:]
+			case protowire.Fixed64Type:
+				value, n := protowire.ConsumeFixed64(message)
+				each(number, kind, nil, value)
+				message = message[n:]
+			case protowire.VarintType:
+				value, n := protowire.ConsumeVarint(message)
+				each(number, kind, nil, value)
+				message = message[n:]
+			default:
+				t.Fatalf("Unexpected protobuf wire type %v", kind)
+			}
+		}
+	}
+	series := map[string][]decodedSample{}
+	fields(body, func(_ protowire.Number, _ protowire.Type, timeSeries []byte, _ uint64) {
+		var name string
+		var sample decodedSample
+		fields(timeSeries, func(number protowire.Number, _ protowire.Type, value []byte, _ uint64) {
+			switch number {
+			case 1:
+				var labelName string
+				fields(value, func(number protowire.Number, _ protowire.Type, value []byte, _ uint64) {
+					if number == 1 {
+						labelName = string(value)
+					} else if labelName == "__name__" {
+						name = string(value)
+					}
+				})
+			case 2:
+				fields(value, func(number protowire.Number, _ protowire.Type, _ []byte, raw uint64) {
+					if number == 1 {
+						sample.value = math.Float64frombits(raw)
+					} else {
+						sample.timestamp = int64(raw)
+					}
+				})
+			}
+		})
+		series[name] = append(series[name], sample)
+	})
+	return series
+}
+
+func TestRemoteWriterWritesSnapshotWithTimestamp(t *testing.T) {
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != REMOTE_WRITE_VERSION {
+			t.Errorf("Invalid remote write headers %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Invalid authorization header '%v'", r.Header.Get("Authorization"))
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("Cannot decode snappy body %v", err)
+		}
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	metrics := NewMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.Collectors()...)
+	metrics.ProjectsGauge.Set(3)
+	metrics.PRsByAuthorGauge.WithLabelValues("project", "repo", "alice").Set(2)
+	writer, err := NewRemoteWriter(RemoteWriteOptions{
+		URL:         ts.URL,
+		BearerToken: "token",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected remote writer error %v", err)
+	}
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := SendToSinks(context.Background(), registry, timestamp, []Sink{writer}); err != nil {
+		t.Fatalf("Unexpected write error %v", err)
+	}
+
+	if len(bodies) != 1 {
+		t.Fatalf("Unexpected %v writes, expected 1", len(bodies))
+	}
+	series := decodeWriteRequest(t, bodies[0])
+	expected := map[string]float64{
+		"bitbucket_projects":      3,
+		"bitbucket_prs_by_author": 2,
+	}
+	for name, value := range expected {
+		samples := series[name]
+		if len(samples) != 1 {
+			t.Errorf("Unexpected %v samples for '%v', expected 1", len(samples), name)
+			continue
+		}
+		if samples[0].value != value || samples[0].timestamp != timestamp.UnixMilli() {
+			t.Errorf("Invalid sample %+v for '%v', expected %v at %v", samples[0], name, value, timestamp.UnixMilli())
+		}
+	}
+}
+
+func TestRemoteWriterRetriesServerErrors(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "username" || password != "password" {
+			t.Errorf("Invalid basic auth '%v:%v'", username, password)
+		}
+		w.WriteHeader(statuses[requests])
+		requests += 1
+	}))
+	defer ts.Close()
+
+	writer, err := NewRemoteWriter(RemoteWriteOptions{
+		URL:      ts.URL,
+		Username: "username",
+		Password: "password",
+		Retries:  2,
+		Backoff:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected remote writer error %v", err)
+	}
+	if err := writer.Send(context.Background(), nil, time.Now()); err != nil {
+		t.Errorf("Unexpected write error %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("Unexpected %v requests, expected 3", requests)
+	}
+}
+
+func TestRemoteWriterDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	writer, err := NewRemoteWriter(RemoteWriteOptions{
+		URL:     ts.URL,
+		Retries: 3,
+		Backoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected remote writer error %v", err)
+	}
+	if err := writer.Send(context.Background(), nil, time.Now()); err == nil {
+		t.Error("Expected an error on a client error")
+	}
+	if requests != 1 {
+		t.Errorf("Unexpected %v requests, expected 1", requests)
+	}
+}
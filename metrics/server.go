@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Server struct {
+	Metrics  *Metrics
+	Registry *prometheus.Registry
+	hostname string
+	port     uint16
+	path     string
+	mux      *http.ServeMux
+	server   *http.Server
+}
+
+func NewServer(hostname string, port uint16, path string, options Options) *Server {
+	metrics := NewMetricsWithOptions(options)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.Collectors()...)
+	if options.RuntimeCollectors {
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		Registry: registry,
+	}))
+	return &Server{
+		Metrics:  metrics,
+		Registry: registry,
+		hostname: hostname,
+		port:     port,
+		path:     path,
+		mux:      mux,
+		server: &http.Server{
+			Addr:    ":" + fmt.Sprint(port),
+			Handler: mux,
+		},
+	}
+}
+
+func (server *Server) Handle(path string, handler http.Handler) {
+	server.mux.Handle(path, handler)
+}
+
+// Handler serves metrics & the rest of handled paths, so the server can be embedded into another one
+func (server *Server) Handler() http.Handler {
+	return server.mux
+}
+
+func (server *Server) ListenAndServe() error {
+	log.WithFields(log.Fields{
+		"hostname": server.hostname,
+		"port":     server.port,
+		"path":     server.path,
+		"url":      fmt.Sprintf("http://%v:%v%v", server.hostname, server.port, server.path),
+	}).Info("Serving metrics via HTTP")
+	err := server.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.server.Shutdown(ctx)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getMetrics(t *testing.T, server *Server) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %v, expected %v", w.Code, http.StatusOK)
+	}
+	body, _ := io.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	server1 := NewServer("localhost", 8080, "/metrics", Options{Prefix: "bitbucket"})
+	server2 := NewServer("localhost", 8080, "/metrics", Options{Prefix: "bitbucket", RuntimeCollectors: true})
+	server1.Metrics.ProjectsGauge.Set(1)
+	server2.Metrics.ProjectsGauge.Set(2)
+
+	body1 := getMetrics(t, server1)
+	if !strings.Contains(body1, "bitbucket_projects 1\n") {
+		t.Errorf("Server 1 metrics lack its projects gauge:\n%v", body1)
+	}
+	if strings.Contains(body1, "go_goroutines") {
+		t.Error("Server 1 metrics unexpectedly contain Go runtime metrics")
+	}
+	body2 := getMetrics(t, server2)
+	if !strings.Contains(body2, "bitbucket_projects 2\n") {
+		t.Errorf("Server 2 metrics lack its projects gauge:\n%v", body2)
+	}
+	if !strings.Contains(body2, "go_goroutines") {
+		t.Error("Server 2 metrics lack Go runtime metrics")
+	}
+}
+
+func TestServerHandlesOtherPaths(t *testing.T) {
+	server := NewServer("localhost", 8080, "/metrics", Options{Prefix: "bitbucket"})
+	server.Handle("/other", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("Unexpected status code %v, expected %v", w.Code, http.StatusTeapot)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// Sink sends the samples of a collection wherever they're stored, all of them sharing the collection timestamp
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, samples []Sample, timestamp time.Time) error
+}
+
+// Samples flattens every gathered series into samples, histograms & summaries as their Prometheus series
+func Samples(gatherer prometheus.Gatherer) ([]Sample, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var samples []Sample
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			add := func(name string, value float64, extraLabels ...Label) {
+				var labels []Label
+				for _, label := range metric.GetLabel() {
+					labels = append(labels, Label{Name: label.GetName(), Value: label.GetValue()})
+				}
+				labels = append(labels, extraLabels...)
+				sort.Slice(labels, func(i, j int) bool {
+					return labels[i].Name < labels[j].Name
+				})
+				samples = append(samples, Sample{Name: name, Labels: labels, Value: value})
+			}
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					le := strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), Label{Name: "le", Value: le})
+				}
+				add(name+"_bucket", float64(histogram.GetSampleCount()), Label{Name: "le", Value: "+Inf"})
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					q := strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)
+					add(name, quantile.GetValue(), Label{Name: "quantile", Value: q})
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			}
+		}
+	}
+	return samples, nil
+}
+
+// SendToSinks gathers the samples once and sends them to every sink, a failing sink doesn't stop the rest
+func SendToSinks(ctx context.Context, gatherer prometheus.Gatherer, timestamp time.Time, sinks []Sink) error {
+	samples, err := Samples(gatherer)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot gather metrics to be sent to sinks")
+		return err
+	}
+	var errs []error
+	for _, sink := range sinks {
+		err := sink.Send(ctx, samples, timestamp)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"sink":  sink.Name(),
+				"error": err,
+			}).Error("Cannot send metrics to sink")
+			errs = append(errs, err)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"sink":    sink.Name(),
+			"samples": len(samples),
+		}).Info("Metrics sent to sink")
+	}
+	return errors.Join(errs...)
+}
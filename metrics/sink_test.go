@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSamplesFlattensHistograms(t *testing.T) {
+	vec := NewSnapshotHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "test_histogram",
+			Help:    "Test histogram",
+			Buckets: []float64{10},
+		},
+		[]string{"repo"},
+	)
+	vec.Set([]string{"repo1"}, []float64{5, 50})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(vec)
+
+	samples, err := Samples(registry)
+	if err != nil {
+		t.Fatalf("Unexpected gather error %v", err)
+	}
+	expected := []Sample{
+		{Name: "test_histogram_bucket", Labels: []Label{{Name: "le", Value: "10"}, {Name: "repo", Value: "repo1"}}, Value: 1},
+		{Name: "test_histogram_bucket", Labels: []Label{{Name: "le", Value: "+Inf"}, {Name: "repo", Value: "repo1"}}, Value: 2},
+		{Name: "test_histogram_sum", Labels: []Label{{Name: "repo", Value: "repo1"}}, Value: 55},
+		{Name: "test_histogram_count", Labels: []Label{{Name: "repo", Value: "repo1"}}, Value: 2},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Unexpected samples %+v, expected %+v", samples, expected)
+	}
+}
+
+func TestInfluxDBSinkSendsLineProtocol(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token token" {
+			t.Errorf("Invalid authorization header '%v'", r.Header.Get("Authorization"))
+		}
+		content, _ := io.ReadAll(r.Body)
+		body = string(content)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	sink, err := NewInfluxDBSink(InfluxDBOptions{URL: ts.URL, Token: "token"})
+	if err != nil {
+		t.Fatalf("Unexpected sink error %v", err)
+	}
+	samples := []Sample{
+		{Name: "bitbucket_projects", Value: 3},
+		{Name: "bitbucket_prs_by_author", Labels: []Label{{Name: "author", Value: "John Doe"}, {Name: "repo", Value: "a,b"}}, Value: 2.5},
+	}
+	timestamp := time.Unix(1714564800, 0)
+	if err := sink.Send(context.Background(), samples, timestamp); err != nil {
+		t.Fatalf("Unexpected send error %v", err)
+	}
+	expected := "bitbucket_projects value=3 1714564800000000000\n" +
+		`bitbucket_prs_by_author,author=John\ Doe,repo=a\,b value=2.5 1714564800000000000` + "\n"
+	if body != expected {
+		t.Errorf("Unexpected line protocol %q, expected %q", body, expected)
+	}
+}
+
+func TestInfluxDBSinkFailsOnErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	sink, _ := NewInfluxDBSink(InfluxDBOptions{URL: ts.URL})
+	if err := sink.Send(context.Background(), []Sample{{Name: "bitbucket_projects", Value: 1}}, time.Now()); err == nil {
+		t.Error("Expected an error on an error status")
+	}
+}
+
+func receiveStatsD(t *testing.T, flavor string, samples []Sample) []string {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen UDP %v", err)
+	}
+	defer listener.Close()
+	sink, err := NewStatsDSink(StatsDOptions{Address: listener.LocalAddr().String(), Flavor: flavor})
+	if err != nil {
+		t.Fatalf("Unexpected sink error %v", err)
+	}
+	if err := sink.Send(context.Background(), samples, time.Now()); err != nil {
+		t.Fatalf("Unexpected send error %v", err)
+	}
+	buffer := make([]byte, STATSD_MAX_PACKET_SIZE)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("Cannot read UDP packet %v", err)
+	}
+	return strings.Split(string(buffer[:n]), "\n")
+}
+
+func TestStatsDSinkSendsGauges(t *testing.T) {
+	samples := []Sample{
+		{Name: "bitbucket_prs_by_author", Labels: []Label{{Name: "author", Value: "john.doe"}, {Name: "repo", Value: "repo-1"}}, Value: 2},
+		{Name: "bitbucket_delta", Value: -1},
+	}
+	lines := receiveStatsD(t, "statsd", samples)
+	expected := []string{
+		"bitbucket_prs_by_author.john_doe.repo-1:2|g",
+		"bitbucket_delta:0|g",
+		"bitbucket_delta:-1|g",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Unexpected StatsD lines %q, expected %q", lines, expected)
+	}
+
+	lines = receiveStatsD(t, "dogstatsd", samples)
+	expected = []string{
+		"bitbucket_prs_by_author:2|g|#author:john.doe,repo:repo-1",
+		"bitbucket_delta:-1|g",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Unexpected DogStatsD lines %q, expected %q", lines, expected)
+	}
+}
+
+func TestStatsDSinkWithUnknownFlavor(t *testing.T) {
+	if _, err := NewStatsDSink(StatsDOptions{Address: "localhost:8125", Flavor: "graphite"}); err == nil {
+		t.Error("Expected an error with an unknown flavor")
+	}
+}
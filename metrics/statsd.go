@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var STATSD_FLAVORS = []string{"statsd", "dogstatsd"}
+
+// Packets are kept under the usual Ethernet MTU, so they're never fragmented
+const STATSD_MAX_PACKET_SIZE = 1432
+
+type StatsDOptions struct {
+	Address string
+	Flavor  string
+}
+
+type StatsDSink struct {
+	address string
+	flavor  string
+}
+
+var statsDInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+var dogStatsDTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_")
+
+func NewStatsDSink(options StatsDOptions) (*StatsDSink, error) {
+	switch options.Flavor {
+	case "statsd", "dogstatsd":
+	default:
+		return nil, fmt.Errorf("unknown StatsD flavor '%s', valid ones are %v", options.Flavor, STATSD_FLAVORS)
+	}
+	return &StatsDSink{
+		address: options.Address,
+		flavor:  options.Flavor,
+	}, nil
+}
+
+func (sink *StatsDSink) Name() string {
+	return sink.flavor
+}
+
+func (sink *StatsDSink) lines(sample Sample) []string {
+	value := strconv.FormatFloat(sample.Value, 'g', -1, 64)
+	if sink.flavor == "dogstatsd" {
+		var tags []string
+		for _, label := range sample.Labels {
+			tags = append(tags, dogStatsDTagEscaper.Replace(label.Name+":"+label.Value))
+		}
+		line := sample.Name + ":" + value + "|g"
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		return []string{line}
+	}
+	// Plain StatsD has no tags, so label values (sorted by label name) become name segments like Graphite ones
+	name := sample.Name
+	for _, label := range sample.Labels {
+		segment := statsDInvalidChars.ReplaceAllString(label.Value, "_")
+		if segment == "" {
+			segment = "none"
+		}
+		name += "." + segment
+	}
+	line := name + ":" + value + "|g"
+	// A signed gauge value is a delta in StatsD, so negative values need the gauge reset first
+	if sample.Value < 0 {
+		return []string{name + ":0|g", line}
+	}
+	return []string{line}
+}
+
+// Send writes every sample as a gauge, StatsD has no timestamps so they're taken when received
+func (sink *StatsDSink) Send(ctx context.Context, samples []Sample, timestamp time.Time) error {
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "udp", sink.address)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := connection.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		for _, line := range sink.lines(sample) {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > STATSD_MAX_PACKET_SIZE {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if packet.Len() > 0 {
+				packet.WriteString("\n")
+			}
+			packet.WriteString(line)
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bitbucket-metrics/bitbucket"
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func startOTLP(config *config.Config, request *bitbucket.Request, gatherer prometheus.Gatherer) *metrics.OTLPExporter {
+	otlpConfig := config.Bitbucket.OTLP
+	// Resource attributes tell the Bitbucket instance, configured ones may override them
+	resourceAttributes := map[string]string{
+		"service.name":      "bitbucket-metrics",
+		"bitbucket.url":     request.BaseURL.String(),
+		"bitbucket.version": request.BitbucketVersion,
+	}
+	for key, value := range otlpConfig.ResourceAttributes {
+		resourceAttributes[key] = value
+	}
+	exporter, err := metrics.NewOTLPExporter(context.Background(), metrics.OTLPOptions{
+		Protocol:           otlpConfig.Protocol,
+		Endpoint:           otlpConfig.Endpoint,
+		Headers:            otlpConfig.Headers,
+		Interval:           time.Duration(otlpConfig.IntervalInSeconds) * time.Second,
+		ResourceAttributes: resourceAttributes,
+	}, gatherer)
+	if err != nil {
+		log.Panic("Cannot export metrics via OTLP")
+	}
+	return exporter
+}
+
+func exportOTLP(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("otlp", flag.ExitOnError)
+	once := flags.Bool("once", false, "Collect & export metrics just once and exit, non-zero exit code on collection or export errors")
+	flags.Parse(args)
+
+	bitbucketRequestManager := initBitbucket(config)
+	metricsToBeCollected := metrics.NewMetricsWithOptions(metricsOptions(config))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsToBeCollected.Collectors()...)
+	runner := newRunner(config, bitbucketRequestManager, metricsToBeCollected)
+	exporter := startOTLP(config, bitbucketRequestManager, registry)
+
+	if *once {
+		collectErr := runner.Collect()
+		err := exporter.Shutdown(context.Background())
+		if collectErr != nil || err != nil {
+			log.Error("Metrics OTLP export failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Otherwise keep exporting after each collection (besides periodically) until stopped
+	runner.AfterCollect(func(err error) {
+		exporter.Flush(context.Background())
+	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runner.RunContext(ctx)
+	exporter.Shutdown(context.Background())
+}
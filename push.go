@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func pushMetrics(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	once := flags.Bool("once", false, "Collect & push metrics just once and exit, non-zero exit code on collection or push errors")
+	flags.Parse(args)
+
+	instance := config.Bitbucket.Push.Instance
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Panic("Cannot get hostname to be used as Pushgateway instance")
+		}
+		instance = hostname
+	}
+
+	bitbucketRequestManager := initBitbucket(config)
+	metricsToBeCollected := metrics.NewMetricsWithOptions(metricsOptions(config))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsToBeCollected.Collectors()...)
+	runner := newRunner(config, bitbucketRequestManager, metricsToBeCollected)
+	pusher, err := metrics.NewPusher(metrics.PushOptions{
+		URL:      config.Bitbucket.Push.URL,
+		Job:      config.Bitbucket.Push.Job,
+		Instance: instance,
+		Username: getEnvOrDefault("PUSH_USERNAME", ""),
+		Password: getEnvOrDefault("PUSH_PASSWORD", ""),
+		TLS:      tlsOptions(config.Bitbucket.Push.TLS),
+	}, registry)
+	if err != nil {
+		log.Panic("Cannot push metrics to Pushgateway")
+	}
+
+	if *once {
+		collectErr := runner.Collect()
+		err := pusher.Push()
+		if collectErr != nil || err != nil {
+			log.Error("Metrics push failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Otherwise keep pushing after each collection until stopped, removing the pushed metrics then.
+	// Stopping cancels the ongoing collection, which is not pushed, so the metrics are removed right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runner.AfterCollect(func(err error) {
+		if ctx.Err() == nil {
+			pusher.Push()
+		}
+	})
+	runner.RunContext(ctx)
+	pusher.Delete()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func startRemoteWrite(config *config.Config) *metrics.RemoteWriter {
+	remoteWriteConfig := config.Bitbucket.RemoteWrite
+	writer, err := metrics.NewRemoteWriter(metrics.RemoteWriteOptions{
+		URL:         remoteWriteConfig.URL,
+		Username:    getEnvOrDefault("REMOTE_WRITE_USERNAME", ""),
+		Password:    getEnvOrDefault("REMOTE_WRITE_PASSWORD", ""),
+		BearerToken: getEnvOrDefault("REMOTE_WRITE_BEARER_TOKEN", ""),
+		Retries:     remoteWriteConfig.Retries,
+		Backoff:     time.Duration(remoteWriteConfig.BackoffInSeconds) * time.Second,
+		Timeout:     time.Duration(remoteWriteConfig.TimeoutInSeconds) * time.Second,
+		TLS:         tlsOptions(remoteWriteConfig.TLS),
+	})
+	if err != nil {
+		log.Panic("Cannot write metrics via remote write")
+	}
+	return writer
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func reveal(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("reveal", flag.ExitOnError)
+	flags.Parse(args)
+	pseudonyms := flags.Args()
+	if config.Bitbucket.Identities.PersonLabels != "hash" {
+		log.Fatal("Pseudonyms are only labeled with 'identities.person_labels: hash'")
+	}
+	if len(pseudonyms) == 0 {
+		log.Fatal("At least a pseudonym to reveal is required")
+	}
+
+	bitbucketRequestManager := initBitbucket(config)
+	runner := newRunner(config, bitbucketRequestManager, metrics.NewMetrics())
+	// Persons are searched among the collected ones, so a partial collection may still reveal them
+	runner.Collect()
+	revealed, err := runner.Reveal(pseudonyms)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Cannot reveal pseudonyms")
+	}
+
+	unknown := false
+	for _, pseudonym := range pseudonyms {
+		person, ok := revealed[pseudonym]
+		if !ok {
+			log.WithFields(log.Fields{
+				"pseudonym": pseudonym,
+			}).Warn("Pseudonym of an unknown person")
+			unknown = true
+			continue
+		}
+		log.WithFields(log.Fields{
+			"pseudonym": pseudonym,
+		}).Warn("Pseudonym revealed")
+		fmt.Printf("%s %s\n", pseudonym, person)
+	}
+	if unknown {
+		os.Exit(1)
+	}
+}
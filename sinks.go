@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bitbucket-metrics/bitbucket"
+	"bitbucket-metrics/config"
+	"bitbucket-metrics/metrics"
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// startSinks creates every enabled sink, remote write included
+func startSinks(config *config.Config) []metrics.Sink {
+	var sinks []metrics.Sink
+	if config.Bitbucket.RemoteWrite.Enabled {
+		sinks = append(sinks, startRemoteWrite(config))
+	}
+	influxDBConfig := config.Bitbucket.Sinks.InfluxDB
+	if influxDBConfig.Enabled {
+		sink, err := metrics.NewInfluxDBSink(metrics.InfluxDBOptions{
+			URL:     influxDBConfig.URL,
+			Token:   getEnvOrDefault("INFLUXDB_TOKEN", ""),
+			Timeout: time.Duration(influxDBConfig.TimeoutInSeconds) * time.Second,
+			TLS:     tlsOptions(influxDBConfig.TLS),
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"url":   influxDBConfig.URL,
+				"error": err,
+			}).Panic("Cannot send metrics to InfluxDB")
+		}
+		sinks = append(sinks, sink)
+	}
+	statsDConfig := config.Bitbucket.Sinks.StatsD
+	if statsDConfig.Enabled {
+		sink, err := metrics.NewStatsDSink(metrics.StatsDOptions{
+			Address: statsDConfig.Address,
+			Flavor:  statsDConfig.Flavor,
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"address": statsDConfig.Address,
+				"error":   err,
+			}).Panic("Cannot send metrics to StatsD")
+		}
+		sinks = append(sinks, sink)
+	}
+	for _, sink := range sinks {
+		log.WithFields(log.Fields{
+			"sink": sink.Name(),
+		}).Info("Sending metrics to sink")
+	}
+	return sinks
+}
+
+// sendAfterCollect sends each completed cycle to the sinks once, its samples timestamped when it was collected
+func sendAfterCollect(runner *bitbucket.Runner, gatherer prometheus.Gatherer, sinks []metrics.Sink) {
+	runner.AfterCollect(func(err error) {
+		metrics.SendToSinks(context.Background(), gatherer, runner.CollectedAt(), sinks)
+	})
+}
+
+func send(config *config.Config, args []string) {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	once := flags.Bool("once", false, "Collect & send metrics just once and exit, non-zero exit code on collection or sink errors")
+	flags.Parse(args)
+
+	bitbucketRequestManager := initBitbucket(config)
+	metricsToBeCollected := metrics.NewMetricsWithOptions(metricsOptions(config))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metricsToBeCollected.Collectors()...)
+	runner := newRunner(config, bitbucketRequestManager, metricsToBeCollected)
+	sinks := startSinks(config)
+	if len(sinks) == 0 {
+		log.Panic("No sink enabled to send metrics to")
+	}
+
+	if *once {
+		collectErr := runner.Collect()
+		err := metrics.SendToSinks(context.Background(), registry, runner.CollectedAt(), sinks)
+		if collectErr != nil || err != nil {
+			log.Error("Metrics sending failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	sendAfterCollect(runner, registry, sinks)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runner.RunContext(ctx)
+}